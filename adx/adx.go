@@ -0,0 +1,263 @@
+// Package adx queries and ingests into Azure Data Explorer clusters using the REST API.
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/token"
+)
+
+const (
+	// appName identifies the adapter to the cluster.
+	appName = "prometheus-eventhubs-adapter"
+)
+
+// Config for an Azure Data Explorer cluster
+type Config struct {
+	// Endpoint is the cluster URI, ex. "https://mycluster.westeurope.kusto.windows.net".
+	Endpoint string
+	// Database is the database queried.
+	Database string
+	// Token for Azure Active Directory authentication. Requests are not
+	// authenticated when no service principal is configured.
+	Token token.Config
+	// Timeout for cluster requests.
+	Timeout time.Duration
+}
+
+// Enabled reports whether a cluster is configured.
+func (cfg *Config) Enabled() bool {
+	return cfg.Endpoint != ""
+}
+
+// Client for the Azure Data Explorer REST API
+type Client struct {
+	endpoint string
+	database string
+	http     *http.Client
+	token    *token.Provider
+}
+
+// NewClient creates an Azure Data Explorer client
+func NewClient(cfg *Config) (*Client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid adx endpoint '%s'", cfg.Endpoint)
+	}
+	if cfg.Database == "" {
+		return nil, errors.New("adx database must not be empty")
+	}
+
+	client := &Client{
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+		database: cfg.Database,
+		http:     &http.Client{Timeout: cfg.Timeout},
+	}
+
+	if cfg.Token.Enabled() {
+		// The cluster URI is the AAD resource
+		provider, err := token.NewProvider(&cfg.Token, client.endpoint)
+		if err != nil {
+			return nil, err
+		}
+		client.token = provider
+	}
+
+	return client, nil
+}
+
+// Column of a query result
+type Column struct {
+	// Name of the column.
+	Name string `json:"ColumnName"`
+	// Type is the Kusto scalar data type.
+	Type string `json:"ColumnType"`
+}
+
+// Table is the primary result of a query
+type Table struct {
+	Columns []Column
+	// Rows hold the values in column order. Numbers are json.Number, dynamic
+	// values are decoded into maps and slices.
+	Rows [][]interface{}
+}
+
+// Index returns the position of a column, or -1 if the table has no such column
+func (t *Table) Index(name string) int {
+	for i, col := range t.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// frame is a single frame of a v2 query response.
+type frame struct {
+	FrameType    string          `json:"FrameType"`
+	TableKind    string          `json:"TableKind"`
+	Columns      []Column        `json:"Columns"`
+	Rows         [][]interface{} `json:"Rows"`
+	HasErrors    bool            `json:"HasErrors"`
+	OneAPIErrors []apiError      `json:"OneApiErrors"`
+}
+
+// apiError is the error body of the REST API.
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Query runs a KQL query against the database and returns its primary result
+//
+// See [ https://learn.microsoft.com/en-us/azure/data-explorer/kusto/api/rest/request ]
+func (c *Client) Query(ctx context.Context, query string) (*Table, error) {
+	resp, err := c.post(ctx, "/v2/rest/query", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var frames []frame
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&frames); err != nil {
+		return nil, fmt.Errorf("decode adx query response: %w", err)
+	}
+
+	var table *Table
+	for _, f := range frames {
+		switch f.FrameType {
+		case "DataTable":
+			if f.TableKind == "PrimaryResult" && table == nil {
+				table = &Table{Columns: f.Columns, Rows: f.Rows}
+			}
+		case "DataSetCompletion":
+			if f.HasErrors {
+				msg := "unknown error"
+				if len(f.OneAPIErrors) > 0 {
+					msg = f.OneAPIErrors[0].Error.Message
+				}
+				return nil, fmt.Errorf("adx query failed: %s", msg)
+			}
+		}
+	}
+	if table == nil {
+		return nil, errors.New("adx query response has no primary result")
+	}
+	return table, nil
+}
+
+// Command runs a management command against the database and returns its first result
+func (c *Client) Command(ctx context.Context, command string) (*Table, error) {
+	resp, err := c.post(ctx, "/v1/rest/mgmt", command)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Management commands respond in the v1 format
+	var result struct {
+		Tables []Table
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode adx command response: %w", err)
+	}
+	if len(result.Tables) == 0 {
+		return nil, errors.New("adx command response has no result")
+	}
+	return &result.Tables[0], nil
+}
+
+// post sends a query or command to the database
+func (c *Client) post(ctx context.Context, path, csl string) (*http.Response, error) {
+	body, err := json.Marshal(map[string]string{"db": c.database, "csl": csl})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+
+	return c.do(req)
+}
+
+// newRequest creates an authorized request to the cluster
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-app", appName)
+	if err := c.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// authorize sets the bearer token of a request
+func (c *Client) authorize(ctx context.Context, req *http.Request) error {
+	if c.token == nil {
+		return nil
+	}
+	bearer, err := c.token.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("adx token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	return nil
+}
+
+// do sends a request, returning an error for unsuccessful responses
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		var apiErr apiError
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error.Message != "" {
+			return nil, fmt.Errorf("adx %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, apiErr.Error.Message)
+		}
+		return nil, fmt.Errorf("adx %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,291 @@
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+)
+
+const (
+	// StreamingIngestion sends batches to the cluster with a request each.
+	StreamingIngestion = "streaming"
+	// QueuedIngestion uploads batches to blob storage and queues them for ingestion.
+	QueuedIngestion = "queued"
+
+	// DefaultMaxBatchBytes is the default limit of the uncompressed data of a
+	// single ingestion, the limit of streaming ingestion requests.
+	DefaultMaxBatchBytes = 4 << 20
+	// maxJoinedErrors limits the per-batch errors kept in an aggregated error.
+	maxJoinedErrors = 5
+)
+
+// IngestConfig for writing samples directly into Azure Data Explorer
+type IngestConfig struct {
+	// Mode is the ingestion method, StreamingIngestion or QueuedIngestion.
+	Mode string
+	// IngestEndpoint is the data management endpoint used by queued ingestion,
+	// ex. "https://ingest-mycluster.westeurope.kusto.windows.net". Derived from
+	// the cluster endpoint when empty.
+	IngestEndpoint string
+	// Routing selects the table and ingestion mapping of each sample.
+	Routing routing.Config
+	// Serializer produces the ingested data, its format must be ingestable.
+	Serializer serializers.SerializerConfig
+	// MaxBatchBytes limits the uncompressed data of a single ingestion.
+	MaxBatchBytes int
+}
+
+// batch is the data ingested into a table at once.
+type batch struct {
+	table   string
+	mapping string
+	data    []byte
+	samples int
+}
+
+// ingester ingests a batch of data.
+type ingester interface {
+	ingest(ctx context.Context, b *batch, format kusto.DataFormat, compressed []byte) error
+}
+
+// Writer sends Prometheus samples to Azure Data Explorer
+type Writer struct {
+	name          string
+	router        *routing.Router
+	serializer    serializers.Serializer
+	format        kusto.DataFormat
+	maxBatchBytes int
+	ingester      ingester
+	clients       []*Client
+}
+
+// NewWriter creates a writer ingesting into the database of cfg
+func NewWriter(cfg *Config, ingest *IngestConfig) (*Writer, error) {
+	ser, err := serializers.NewSerializer(&ingest.Serializer)
+	if err != nil {
+		return nil, err
+	}
+
+	format := ser.ADXFormat()
+	if !format.IsADX() {
+		return nil, fmt.Errorf("serializer '%s' does not produce an Azure Data Explorer format", ingest.Serializer.DataFormat)
+	}
+
+	router, err := routing.New(&ingest.Routing)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, _ := url.Parse(client.endpoint)
+
+	w := &Writer{
+		name:          endpoint.Host + "/" + cfg.Database,
+		router:        router,
+		serializer:    ser,
+		format:        format,
+		maxBatchBytes: ingest.MaxBatchBytes,
+		clients:       []*Client{client},
+	}
+	if w.maxBatchBytes <= 0 {
+		w.maxBatchBytes = DefaultMaxBatchBytes
+	}
+
+	switch strings.ToLower(ingest.Mode) {
+	case "", StreamingIngestion:
+		w.ingester = &streamingIngester{client: client}
+	case QueuedIngestion:
+		dm := *cfg
+		dm.Endpoint = ingest.IngestEndpoint
+		if dm.Endpoint == "" {
+			dm.Endpoint = ingestEndpoint(endpoint)
+		}
+		dmClient, err := NewClient(&dm)
+		if err != nil {
+			return nil, err
+		}
+		w.ingester = newQueuedIngester(dmClient)
+		w.clients = append(w.clients, dmClient)
+	default:
+		return nil, fmt.Errorf("unknown adx ingestion mode '%s'", ingest.Mode)
+	}
+
+	return w, nil
+}
+
+// ingestEndpoint returns the data management endpoint of a cluster
+func ingestEndpoint(cluster *url.URL) string {
+	dm := *cluster
+	dm.Host = "ingest-" + cluster.Host
+	return strings.TrimSuffix(dm.String(), "/")
+}
+
+// Write serializes samples into batches per table and ingests them
+//
+// returns the outcome of each sample and, when batches were not ingested, an error.
+func (w *Writer) Write(ctx context.Context, samples model.Samples) (remote.Result, error) {
+	var result remote.Result
+
+	// Stop processing if empty
+	if len(samples) == 0 {
+		return result, nil
+	}
+
+	begin := time.Now()
+	batches := w.batches(samples, &result)
+
+	var (
+		failed int
+		errs   []error
+	)
+	for _, b := range batches {
+		compressed, err := compression.GzipCompression.Compress(b.data)
+		if err != nil {
+			return result, err
+		}
+		result.Bytes += len(b.data)
+		result.CompressedBytes += len(compressed)
+
+		if err := w.ingester.ingest(ctx, b, w.format, compressed); err != nil {
+			log.ErrorObj(err).Str("table", b.table).Int("count", b.samples).Msg("ingest batch")
+			result.SendFailed += b.samples
+			failed++
+			if len(errs) < maxJoinedErrors {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		result.Sent += b.samples
+	}
+
+	duration := time.Since(begin).Seconds()
+	log.Debug().Int("count", len(samples)).Int("batches", len(batches)).Int("sent", result.Sent).Int("serialize_failed", result.SerializeFailed).Int("send_failed", result.SendFailed).Int("dropped", result.Dropped).Float64("duration_sec", duration).Msg("Ingested samples into Azure Data Explorer")
+
+	if failed > 0 {
+		return result, fmt.Errorf("ingest %d of %d batches failed: %w", failed, len(batches), errors.Join(errs...))
+	}
+	return result, nil
+}
+
+// batches serializes samples into batches, grouped by table and mapping in order of appearance
+//
+// Records are separated by newlines, which Azure Data Explorer reads as
+// multiple records for every ingestable format.
+func (w *Writer) batches(samples model.Samples, result *remote.Result) []*batch {
+	type key struct{ table, mapping string }
+	open := make(map[key]*batch)
+	var batches []*batch
+
+	for _, sample := range samples {
+		serialized, err := w.serializer.Serialize(*sample)
+		if errors.Is(err, serializers.ErrDropped) {
+			result.Dropped++
+			continue
+		}
+		if err != nil {
+			log.ErrorObj(err).Msg("Could not serialize sample")
+			result.SerializeFailed++
+			continue
+		}
+
+		data := routing.NewData(sample.Metric)
+		k := key{table: w.router.Table(data), mapping: w.router.Mapping(data)}
+
+		b, ok := open[k]
+		if ok && len(b.data)+len(serialized)+1 > w.maxBatchBytes {
+			// Full, later samples start a new batch
+			ok = false
+		}
+		if !ok {
+			b = &batch{table: k.table, mapping: k.mapping}
+			open[k] = b
+			batches = append(batches, b)
+		}
+
+		b.data = append(b.data, serialized...)
+		b.data = append(b.data, '\n')
+		b.samples++
+	}
+
+	return batches
+}
+
+// Close shuts down any idle connections
+func (w *Writer) Close(ctx context.Context) error {
+	for _, c := range w.clients {
+		c.http.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Name identifies the cluster and database written to
+func (w *Writer) Name() string {
+	return w.name
+}
+
+// Ping checks the connection to the cluster and database with a management command
+func (w *Writer) Ping(ctx context.Context) error {
+	_, err := w.clients[0].Command(ctx, ".show version")
+	return err
+}
+
+// streamingIngester ingests batches using streaming ingestion.
+//
+// See [ https://learn.microsoft.com/en-us/azure/data-explorer/kusto/api/rest/streaming-ingest ]
+type streamingIngester struct {
+	client *Client
+}
+
+func (s *streamingIngester) ingest(ctx context.Context, b *batch, format kusto.DataFormat, compressed []byte) error {
+	query := url.Values{"streamFormat": {format.String()}}
+	if b.mapping != "" {
+		query.Set("mappingName", b.mapping)
+	}
+	path := "/v1/rest/ingest/" + url.PathEscape(s.client.database) + "/" + url.PathEscape(b.table) + "?" + query.Encode()
+
+	req, err := s.client.newRequest(ctx, http.MethodPost, path, bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", compression.GzipCompression.String())
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.client.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
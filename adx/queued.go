@@ -0,0 +1,254 @@
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v4/uuid"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+)
+
+const (
+	// resourcesRefresh is how long ingestion resources and the identity token are reused.
+	resourcesRefresh = time.Hour
+	// storageVersion is the Azure Storage REST API version used for blobs and queues.
+	storageVersion = "2019-12-12"
+)
+
+// resources are the storage locations and identity token of queued ingestion.
+type resources struct {
+	queues     []string
+	containers []string
+	authCtx    string
+	expires    time.Time
+}
+
+// queuedIngester ingests batches using queued ingestion
+//
+// Batches are uploaded as blobs to a temporary storage container of the
+// cluster, and an ingestion message referencing the blob is posted to an
+// ingestion queue. Both are discovered from the data management endpoint.
+//
+// See [ https://learn.microsoft.com/en-us/azure/data-explorer/kusto/api/netfx/kusto-ingest-client-rest ]
+type queuedIngester struct {
+	client *Client
+
+	mu        sync.Mutex
+	resources *resources
+	next      int
+}
+
+// newQueuedIngester creates a queued ingester using the data management client
+func newQueuedIngester(client *Client) *queuedIngester {
+	return &queuedIngester{client: client}
+}
+
+// ingestionMessage is the queue message requesting the ingestion of a blob.
+type ingestionMessage struct {
+	ID                   string            `json:"Id"`
+	BlobPath             string            `json:"BlobPath"`
+	RawDataSize          int               `json:"RawDataSize"`
+	DatabaseName         string            `json:"DatabaseName"`
+	TableName            string            `json:"TableName"`
+	RetainBlobOnSuccess  bool              `json:"RetainBlobOnSuccess"`
+	FlushImmediately     bool              `json:"FlushImmediately"`
+	ReportLevel          int               `json:"ReportLevel"`
+	ReportMethod         int               `json:"ReportMethod"`
+	AdditionalProperties map[string]string `json:"AdditionalProperties"`
+}
+
+// queueMessage is the Azure Storage queue message body.
+type queueMessage struct {
+	XMLName     xml.Name `xml:"QueueMessage"`
+	MessageText string   `xml:"MessageText"`
+}
+
+func (q *queuedIngester) ingest(ctx context.Context, b *batch, format kusto.DataFormat, compressed []byte) error {
+	res, queue, container, err := q.pick(ctx)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	blobName := fmt.Sprintf("%s__%s__%s.%s.gz", q.client.database, b.table, id, format)
+	blobURL, err := storageURL(container, blobName)
+	if err != nil {
+		return err
+	}
+	if err := q.upload(ctx, blobURL, compressed); err != nil {
+		return err
+	}
+
+	properties := map[string]string{
+		"authorizationContext": res.authCtx,
+		"format":               format.String(),
+	}
+	if b.mapping != "" {
+		properties["ingestionMappingReference"] = b.mapping
+	}
+
+	msg, err := json.Marshal(ingestionMessage{
+		ID:           id.String(),
+		BlobPath:     blobURL,
+		RawDataSize:  len(b.data),
+		DatabaseName: q.client.database,
+		TableName:    b.table,
+		// Temporary storage is cleaned up by the cluster
+		RetainBlobOnSuccess:  true,
+		AdditionalProperties: properties,
+	})
+	if err != nil {
+		return err
+	}
+
+	return q.enqueue(ctx, queue, msg)
+}
+
+// pick returns the ingestion resources and the queue and container of the next ingestion
+//
+// Ingestions are spread over the queues and containers round-robin.
+func (q *queuedIngester) pick(ctx context.Context) (*resources, string, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.resources == nil || time.Now().After(q.resources.expires) {
+		res, err := q.fetch(ctx)
+		if err != nil {
+			if q.resources == nil {
+				return nil, "", "", err
+			}
+			// Keep using the previous resources until the cluster is reachable
+			q.resources.expires = time.Now().Add(time.Minute)
+		} else {
+			q.resources = res
+		}
+	}
+
+	res := q.resources
+	q.next++
+	return res, res.queues[q.next%len(res.queues)], res.containers[q.next%len(res.containers)], nil
+}
+
+// fetch requests the ingestion resources and identity token from the data management endpoint
+func (q *queuedIngester) fetch(ctx context.Context) (*resources, error) {
+	table, err := q.client.Command(ctx, ".get ingestion resources")
+	if err != nil {
+		return nil, fmt.Errorf("get ingestion resources: %w", err)
+	}
+
+	res := &resources{expires: time.Now().Add(resourcesRefresh)}
+	nameCol, rootCol := table.Index("ResourceTypeName"), table.Index("StorageRoot")
+	if nameCol < 0 || rootCol < 0 {
+		return nil, errors.New("ingestion resources are missing columns")
+	}
+	for _, row := range table.Rows {
+		name, _ := row[nameCol].(string)
+		root, _ := row[rootCol].(string)
+		switch name {
+		case "SecuredReadyForAggregationQueue":
+			res.queues = append(res.queues, root)
+		case "TempStorage":
+			res.containers = append(res.containers, root)
+		}
+	}
+	if len(res.queues) == 0 || len(res.containers) == 0 {
+		return nil, errors.New("ingestion resources have no queue or temporary storage")
+	}
+
+	table, err = q.client.Command(ctx, ".get kusto identity token")
+	if err != nil {
+		return nil, fmt.Errorf("get kusto identity token: %w", err)
+	}
+	authCol := table.Index("AuthorizationContext")
+	if authCol < 0 || len(table.Rows) == 0 {
+		return nil, errors.New("kusto identity token is missing")
+	}
+	res.authCtx, _ = table.Rows[0][authCol].(string)
+
+	return res, nil
+}
+
+// upload creates a block blob
+func (q *queuedIngester) upload(ctx context.Context, blobURL string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, blobURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", storageVersion)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := q.client.do(req)
+	if err != nil {
+		return fmt.Errorf("upload blob: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+// enqueue posts an ingestion message to a queue
+func (q *queuedIngester) enqueue(ctx context.Context, queue string, msg []byte) error {
+	messagesURL, err := storageURL(queue, "messages")
+	if err != nil {
+		return err
+	}
+
+	body, err := xml.Marshal(queueMessage{MessageText: base64.StdEncoding.EncodeToString(msg)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, messagesURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-version", storageVersion)
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := q.client.do(req)
+	if err != nil {
+		return fmt.Errorf("enqueue ingestion: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+// storageURL appends a path element to a storage URL, keeping its SAS query
+func storageURL(root, elem string) (string, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return "", fmt.Errorf("invalid storage url: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + elem
+	u.RawPath = ""
+	return u.String(), nil
+}
@@ -0,0 +1,423 @@
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+)
+
+// blob is an uploaded blob of the storage stand-in.
+type blob struct {
+	path    string
+	query   string
+	header  http.Header
+	content []byte
+}
+
+// ingestStandIn serves the data management commands, blob uploads and queue
+// messages of queued ingestion on a single server
+type ingestStandIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	commands []string
+	blobs    []blob
+	messages []queueMessage
+	queues   []string
+
+	// resources and token answer the management commands, overridden by tests.
+	resources func(root string) (int, string)
+	token     func() (int, string)
+	// blobStatus and queueStatus are the status codes of uploads and messages.
+	blobStatus  int
+	queueStatus int
+}
+
+func newIngestStandIn(t *testing.T) *ingestStandIn {
+	t.Helper()
+	s := &ingestStandIn{
+		resources: func(root string) (int, string) {
+			return http.StatusOK, mgmtResult([]Column{{Name: "ResourceTypeName"}, {Name: "StorageRoot"}}, [][]interface{}{
+				{"SecuredReadyForAggregationQueue", root + "/queue-a?sig=qa"},
+				{"SecuredReadyForAggregationQueue", root + "/queue-b?sig=qb"},
+				{"TempStorage", root + "/container?sig=c"},
+				{"FailedIngestionsQueue", root + "/failed?sig=f"},
+			})
+		},
+		token: func() (int, string) {
+			return http.StatusOK, mgmtResult([]Column{{Name: "AuthorizationContext"}}, [][]interface{}{{"auth-context"}})
+		},
+		blobStatus:  http.StatusCreated,
+		queueStatus: http.StatusCreated,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *ingestStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/rest/mgmt":
+		var body struct {
+			CSL string `json:"csl"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.commands = append(s.commands, body.CSL)
+
+		var status int
+		var resp string
+		switch body.CSL {
+		case ".get ingestion resources":
+			status, resp = s.resources(s.URL)
+		case ".get kusto identity token":
+			status, resp = s.token()
+		default:
+			status, resp = http.StatusBadRequest, `{"error":{"code":"BadRequest","message":"unknown command"}}`
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, resp)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/container/"):
+		content, _ := io.ReadAll(r.Body)
+		s.blobs = append(s.blobs, blob{path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, content: content})
+		if s.blobStatus != http.StatusCreated {
+			w.WriteHeader(s.blobStatus)
+			io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>AuthenticationFailed</Code></Error>`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/messages"):
+		if r.Header.Get("Content-Type") != "application/xml" || r.Header.Get("x-ms-version") != storageVersion {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		var msg queueMessage
+		if err := xml.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.messages = append(s.messages, msg)
+		s.queues = append(s.queues, strings.TrimSuffix(r.URL.Path, "/messages")+"?"+r.URL.RawQuery)
+		if s.queueStatus != http.StatusCreated {
+			http.Error(w, "queue unavailable", s.queueStatus)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+// mgmtResult returns a v1 management command response with a single table
+func mgmtResult(columns []Column, rows [][]interface{}) string {
+	resp, _ := json.Marshal(map[string]interface{}{
+		"Tables": []Table{{Columns: columns, Rows: rows}},
+	})
+	return string(resp)
+}
+
+func newTestQueuedIngester(t *testing.T, endpoint string) *queuedIngester {
+	t.Helper()
+	client, err := NewClient(&Config{Endpoint: endpoint, Database: "metrics", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newQueuedIngester(client)
+}
+
+// decodeIngestion returns the ingestion message of a queue message
+func decodeIngestion(t *testing.T, msg queueMessage) ingestionMessage {
+	t.Helper()
+	text, err := base64.StdEncoding.DecodeString(msg.MessageText)
+	if err != nil {
+		t.Fatalf("message text is not base64: %v", err)
+	}
+	var ingestion ingestionMessage
+	if err := json.Unmarshal(text, &ingestion); err != nil {
+		t.Fatalf("message text is not an ingestion message: %v", err)
+	}
+	return ingestion
+}
+
+func TestQueuedIngest(t *testing.T) {
+	s := newIngestStandIn(t)
+	q := newTestQueuedIngester(t, s.URL)
+
+	b := &batch{table: "up", mapping: "up_mapping", data: []byte("{\"value\":1}\n"), samples: 1}
+	compressed := []byte("compressed data")
+	if err := q.ingest(context.Background(), b, kusto.JSONFormat, compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.blobs) != 1 {
+		t.Fatalf("uploaded %d blobs, want 1", len(s.blobs))
+	}
+	up := s.blobs[0]
+	if !strings.HasPrefix(up.path, "/container/metrics__up__") || !strings.HasSuffix(up.path, ".json.gz") {
+		t.Errorf("blob path = %q", up.path)
+	}
+	if up.query != "sig=c" {
+		t.Errorf("blob query = %q, want the SAS of the container", up.query)
+	}
+	if got := up.header.Get("x-ms-blob-type"); got != "BlockBlob" {
+		t.Errorf("x-ms-blob-type = %q", got)
+	}
+	if got := up.header.Get("x-ms-version"); got != storageVersion {
+		t.Errorf("x-ms-version = %q", got)
+	}
+	if !bytes.Equal(up.content, compressed) {
+		t.Errorf("blob content = %q, want %q", up.content, compressed)
+	}
+
+	if len(s.messages) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(s.messages))
+	}
+	msg := decodeIngestion(t, s.messages[0])
+	if msg.ID == "" || !strings.Contains(up.path, msg.ID) {
+		t.Errorf("message id %q does not name the blob %q", msg.ID, up.path)
+	}
+	if want := s.URL + up.path + "?sig=c"; msg.BlobPath != want {
+		t.Errorf("BlobPath = %q, want %q", msg.BlobPath, want)
+	}
+	if msg.RawDataSize != len(b.data) {
+		t.Errorf("RawDataSize = %d, want the uncompressed size %d", msg.RawDataSize, len(b.data))
+	}
+	if msg.DatabaseName != "metrics" || msg.TableName != "up" {
+		t.Errorf("database and table = %q, %q", msg.DatabaseName, msg.TableName)
+	}
+	if !msg.RetainBlobOnSuccess {
+		t.Error("RetainBlobOnSuccess = false")
+	}
+	wantProps := map[string]string{
+		"authorizationContext":      "auth-context",
+		"format":                    "json",
+		"ingestionMappingReference": "up_mapping",
+	}
+	if len(msg.AdditionalProperties) != len(wantProps) {
+		t.Errorf("AdditionalProperties = %v, want %v", msg.AdditionalProperties, wantProps)
+	}
+	for k, v := range wantProps {
+		if msg.AdditionalProperties[k] != v {
+			t.Errorf("AdditionalProperties[%q] = %q, want %q", k, msg.AdditionalProperties[k], v)
+		}
+	}
+}
+
+func TestQueuedIngestNoMapping(t *testing.T) {
+	s := newIngestStandIn(t)
+	q := newTestQueuedIngester(t, s.URL)
+
+	b := &batch{table: "up", data: []byte("1,2\n"), samples: 1}
+	if err := q.ingest(context.Background(), b, kusto.CSVFormat, []byte("csv")); err != nil {
+		t.Fatal(err)
+	}
+	msg := decodeIngestion(t, s.messages[0])
+	if _, ok := msg.AdditionalProperties["ingestionMappingReference"]; ok {
+		t.Errorf("AdditionalProperties = %v, want no mapping reference", msg.AdditionalProperties)
+	}
+	if msg.AdditionalProperties["format"] != "csv" {
+		t.Errorf("format = %q, want csv", msg.AdditionalProperties["format"])
+	}
+}
+
+func TestQueuedIngestRoundRobin(t *testing.T) {
+	s := newIngestStandIn(t)
+	q := newTestQueuedIngester(t, s.URL)
+
+	b := &batch{table: "up", data: []byte("x\n"), samples: 1}
+	for i := 0; i < 4; i++ {
+		if err := q.ingest(context.Background(), b, kusto.JSONFormat, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Resources and the token are fetched once and reused
+	if len(s.commands) != 2 {
+		t.Errorf("commands = %q, want one resources and one token request", s.commands)
+	}
+	if s.queues[0] == s.queues[1] || s.queues[0] != s.queues[2] || s.queues[1] != s.queues[3] {
+		t.Errorf("queues = %q, want alternating queues", s.queues)
+	}
+	for _, queue := range s.queues {
+		if queue != "/queue-a?sig=qa" && queue != "/queue-b?sig=qb" {
+			t.Errorf("queued to %q, want an ingestion queue with its SAS", queue)
+		}
+	}
+}
+
+func TestQueuedIngestKeepsResources(t *testing.T) {
+	s := newIngestStandIn(t)
+	q := newTestQueuedIngester(t, s.URL)
+
+	b := &batch{table: "up", data: []byte("x\n"), samples: 1}
+	if err := q.ingest(context.Background(), b, kusto.JSONFormat, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired resources are used while the data management endpoint fails
+	s.mu.Lock()
+	s.resources = func(string) (int, string) {
+		return http.StatusServiceUnavailable, `{"error":{"code":"ServiceUnavailable","message":"unavailable"}}`
+	}
+	s.mu.Unlock()
+	q.resources.expires = time.Now().Add(-time.Second)
+	if err := q.ingest(context.Background(), b, kusto.JSONFormat, []byte("x")); err != nil {
+		t.Fatalf("ingest with expired resources: %v", err)
+	}
+	if len(s.messages) != 2 {
+		t.Errorf("queued %d messages, want 2", len(s.messages))
+	}
+	if !q.resources.expires.After(time.Now()) {
+		t.Error("failed refresh did not postpone the next refresh")
+	}
+}
+
+func TestQueuedIngestErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources func(root string) (int, string)
+		token     func() (int, string)
+		blob      int
+		queue     int
+		want      string
+		uploads   int
+	}{
+		{
+			name: "resources unauthorized",
+			resources: func(string) (int, string) {
+				return http.StatusUnauthorized, `{"error":{"code":"Unauthorized","message":"token expired"}}`
+			},
+			want: "get ingestion resources: adx POST /v1/rest/mgmt: 401 Unauthorized: token expired",
+		},
+		{
+			name: "resources missing columns",
+			resources: func(string) (int, string) {
+				return http.StatusOK, mgmtResult([]Column{{Name: "Name"}}, nil)
+			},
+			want: "ingestion resources are missing columns",
+		},
+		{
+			name: "no temporary storage",
+			resources: func(root string) (int, string) {
+				return http.StatusOK, mgmtResult([]Column{{Name: "ResourceTypeName"}, {Name: "StorageRoot"}}, [][]interface{}{
+					{"SecuredReadyForAggregationQueue", root + "/queue-a"},
+				})
+			},
+			want: "ingestion resources have no queue or temporary storage",
+		},
+		{
+			name: "token failed",
+			token: func() (int, string) {
+				return http.StatusForbidden, "forbidden"
+			},
+			want: "get kusto identity token: adx POST /v1/rest/mgmt: 403 Forbidden: forbidden",
+		},
+		{
+			name: "token missing",
+			token: func() (int, string) {
+				return http.StatusOK, mgmtResult([]Column{{Name: "AuthorizationContext"}}, nil)
+			},
+			want: "kusto identity token is missing",
+		},
+		{
+			name:    "upload forbidden",
+			blob:    http.StatusForbidden,
+			want:    "upload blob: adx PUT /container/",
+			uploads: 1,
+		},
+		{
+			name:    "queue unavailable",
+			queue:   http.StatusServiceUnavailable,
+			want:    "enqueue ingestion: adx POST /queue-b/messages: 503 Service Unavailable: queue unavailable",
+			uploads: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIngestStandIn(t)
+			if tt.resources != nil {
+				s.resources = tt.resources
+			}
+			if tt.token != nil {
+				s.token = tt.token
+			}
+			if tt.blob != 0 {
+				s.blobStatus = tt.blob
+			}
+			if tt.queue != 0 {
+				s.queueStatus = tt.queue
+			}
+			q := newTestQueuedIngester(t, s.URL)
+
+			b := &batch{table: "up", data: []byte("x\n"), samples: 1}
+			err := q.ingest(context.Background(), b, kusto.JSONFormat, []byte("x"))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("ingest error = %v, want %q", err, tt.want)
+			}
+			if len(s.blobs) != tt.uploads {
+				t.Errorf("uploaded %d blobs, want %d", len(s.blobs), tt.uploads)
+			}
+			if tt.blob != 0 && len(s.messages) != 0 {
+				t.Errorf("queued %d messages after a failed upload", len(s.messages))
+			}
+		})
+	}
+}
+
+func TestStorageURL(t *testing.T) {
+	tests := []struct {
+		root string
+		elem string
+		want string
+	}{
+		{"https://acct.blob.core.windows.net/container?sv=1&sig=a%2Bb", "blob.json.gz", "https://acct.blob.core.windows.net/container/blob.json.gz?sv=1&sig=a%2Bb"},
+		{"https://acct.queue.core.windows.net/queue/?sig=x", "messages", "https://acct.queue.core.windows.net/queue/messages?sig=x"},
+		{"http://127.0.0.1:10000/devstoreaccount1/container", "blob", "http://127.0.0.1:10000/devstoreaccount1/container/blob"},
+	}
+	for _, tt := range tests {
+		got, err := storageURL(tt.root, tt.elem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("storageURL(%q, %q) = %q, want %q", tt.root, tt.elem, got, tt.want)
+		}
+	}
+
+	if _, err := storageURL("://bad", "blob"); err == nil {
+		t.Error("storageURL of an invalid url succeeded")
+	}
+}
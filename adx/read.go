@@ -0,0 +1,385 @@
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+// Result columns of a read query
+const (
+	timestampColumn = "__timestamp"
+	valueColumn     = "__value"
+	nameColumn      = "__name"
+	labelsColumn    = "__labels"
+	staleColumn     = "__stale"
+)
+
+// ErrNameMatcher is returned for queries without an equality matcher on the
+// metric name, when the table is selected by the metric name.
+var ErrNameMatcher = errors.New("the table is selected by the metric name, queries need an equality matcher on " + model.MetricNameLabel)
+
+// ReadConfig for reading samples back from the tables written by the serializers
+type ReadConfig struct {
+	// Routing selects the table of a query, rendered against the metric name
+	// and the labels of the equality matchers.
+	Routing routing.Config
+	// Record is the output field layout of the stored events.
+	Record record.Options
+	// MaxSamples limits the samples returned by a single query, 0 disables the limit.
+	MaxSamples int
+}
+
+// Reader answers Prometheus remote read queries from Azure Data Explorer
+type Reader struct {
+	client     *Client
+	router     *routing.Router
+	opts       record.Options
+	layout     []record.Field
+	maxSamples int
+}
+
+// NewReader creates a remote read query reader
+func NewReader(client *Client, cfg *ReadConfig) (*Reader, error) {
+	if err := cfg.Record.Validate(); err != nil {
+		return nil, err
+	}
+
+	router, err := routing.New(&cfg.Routing)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		client:     client,
+		router:     router,
+		opts:       cfg.Record,
+		layout:     cfg.Record.Layout(),
+		maxSamples: cfg.MaxSamples,
+	}, nil
+}
+
+// Read returns the series matching a remote read query, with labels and samples sorted
+func (r *Reader) Read(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	query, err := r.Query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := r.client.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.maxSamples > 0 && len(table.Rows) > r.maxSamples {
+		return nil, fmt.Errorf("query returns more than %d samples", r.maxSamples)
+	}
+
+	return r.series(table)
+}
+
+// Query returns the KQL query of a remote read query
+//
+// A single table is queried, selected like the samples were routed. Unless
+// the table does not depend on the metric name, the query needs an equality
+// matcher on the metric name, returns ErrNameMatcher otherwise.
+func (r *Reader) Query(q *prompb.Query) (string, error) {
+	f := &r.opts.Fields
+
+	// Route the query like the samples it selects were routed
+	data := routing.Data{Labels: make(map[string]string)}
+	named := false
+	for _, m := range q.Matchers {
+		if m.Type != prompb.LabelMatcher_EQ {
+			continue
+		}
+		if m.Name == model.MetricNameLabel {
+			data.Name = m.Value
+			named = true
+		} else {
+			data.Labels[m.Name] = m.Value
+		}
+	}
+	if !named && r.nameRouted(data) {
+		return "", ErrNameMatcher
+	}
+
+	var b strings.Builder
+	b.WriteString(kusto.QuoteName(r.router.Table(data)))
+
+	fmt.Fprintf(&b, "\n| where %s between (unixtime_milliseconds_todatetime(%d) .. unixtime_milliseconds_todatetime(%d))", kusto.QuoteName(f.Timestamp), q.StartTimestampMs, q.EndTimestampMs)
+
+	for _, m := range q.Matchers {
+		cond, err := r.condition(m)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("\n| where " + cond)
+	}
+
+	if f.Flatten {
+		b.WriteString("\n| extend " + labelsColumn + " = pack_all()")
+	} else {
+		b.WriteString("\n| extend " + labelsColumn + " = " + r.labelsExpr())
+	}
+
+	project := []string{
+		timestampColumn + " = " + kusto.QuoteName(f.Timestamp),
+		valueColumn + " = " + kusto.QuoteName(f.Value),
+		nameColumn + " = " + kusto.QuoteName(f.Name),
+		labelsColumn,
+	}
+	if r.opts.Values.StaleField() {
+		project = append(project, staleColumn+" = "+kusto.QuoteName(f.Stale))
+	}
+	b.WriteString("\n| project " + strings.Join(project, ", "))
+
+	if r.maxSamples > 0 {
+		// One extra row detects queries over the limit
+		fmt.Fprintf(&b, "\n| take %d", r.maxSamples+1)
+	}
+
+	return b.String(), nil
+}
+
+// nameRouted reports whether the table of a query depends on the metric name
+func (r *Reader) nameRouted(data routing.Data) bool {
+	a, b := data, data
+	a.Name, b.Name = "a", "b"
+	return r.router.Table(a) != r.router.Table(b)
+}
+
+// condition returns the KQL predicate of a label matcher
+//
+// Prometheus treats a missing label as the empty string, which tostring()
+// returns for missing properties and columns.
+func (r *Reader) condition(m *prompb.LabelMatcher) (string, error) {
+	expr := r.labelExpr(m.Name)
+
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return expr + " == " + kusto.QuoteString(m.Value), nil
+	case prompb.LabelMatcher_NEQ:
+		return expr + " != " + kusto.QuoteString(m.Value), nil
+	case prompb.LabelMatcher_RE:
+		// Prometheus regular expressions are fully anchored
+		return expr + " matches regex " + kusto.QuoteString("^(?:"+m.Value+")$"), nil
+	case prompb.LabelMatcher_NRE:
+		return "not(" + expr + " matches regex " + kusto.QuoteString("^(?:"+m.Value+")$") + ")", nil
+	default:
+		return "", fmt.Errorf("unknown label matcher type %d", m.Type)
+	}
+}
+
+// labelExpr returns the KQL expression of a label value
+func (r *Reader) labelExpr(label string) string {
+	f := &r.opts.Fields
+
+	switch {
+	case label == model.MetricNameLabel:
+		return kusto.QuoteName(f.Name)
+	case f.Flatten:
+		return "tostring(column_ifexists(" + kusto.QuoteString(f.Prefix+label) + ", ''))"
+	case r.promoted(label):
+		return "tostring(" + kusto.QuoteName(f.Prefix+label) + ")"
+	case f.Labels != "":
+		return "tostring(" + kusto.QuoteName(f.Labels) + "[" + kusto.QuoteString(label) + "])"
+	default:
+		// The label is not stored
+		return "''"
+	}
+}
+
+// labelsExpr returns the KQL expression of the label set, merging promoted labels
+func (r *Reader) labelsExpr() string {
+	f := &r.opts.Fields
+
+	var promoted []string
+	for _, label := range f.Promote {
+		promoted = append(promoted, kusto.QuoteString(label), kusto.QuoteName(f.Prefix+label))
+	}
+
+	switch {
+	case f.Labels != "" && len(promoted) > 0:
+		return "bag_merge(" + kusto.QuoteName(f.Labels) + ", bag_pack(" + strings.Join(promoted, ", ") + "))"
+	case f.Labels != "":
+		return kusto.QuoteName(f.Labels)
+	case len(promoted) > 0:
+		return "bag_pack(" + strings.Join(promoted, ", ") + ")"
+	default:
+		return "dynamic({})"
+	}
+}
+
+func (r *Reader) promoted(label string) bool {
+	for _, p := range r.opts.Fields.Promote {
+		if p == label {
+			return true
+		}
+	}
+	return false
+}
+
+// series groups the rows of a query result into time series
+func (r *Reader) series(table *Table) ([]*prompb.TimeSeries, error) {
+	tsCol, valueCol, nameCol, labelsCol, staleCol := table.Index(timestampColumn), table.Index(valueColumn), table.Index(nameColumn), table.Index(labelsColumn), table.Index(staleColumn)
+	if tsCol < 0 || valueCol < 0 || nameCol < 0 || labelsCol < 0 {
+		return nil, fmt.Errorf("adx query result is missing columns")
+	}
+
+	index := make(map[string]*prompb.TimeSeries)
+	var series []*prompb.TimeSeries
+
+	for _, row := range table.Rows {
+		if len(row) != len(table.Columns) {
+			return nil, fmt.Errorf("adx query result row has %d values, expected %d", len(row), len(table.Columns))
+		}
+
+		ts, err := timestampMs(row[tsCol])
+		if err != nil {
+			return nil, err
+		}
+
+		stale := staleCol >= 0 && row[staleCol] == true
+		v, err := sampleValue(row[valueCol], stale)
+		if err != nil {
+			return nil, err
+		}
+
+		labels := r.rowLabels(row[nameCol], row[labelsCol])
+		key := labelsKey(labels)
+		s, ok := index[key]
+		if !ok {
+			s = &prompb.TimeSeries{Labels: labels}
+			index[key] = s
+			series = append(series, s)
+		}
+		s.Samples = append(s.Samples, prompb.Sample{Value: v, Timestamp: ts})
+	}
+
+	for _, s := range series {
+		sort.Slice(s.Samples, func(i, j int) bool { return s.Samples[i].Timestamp < s.Samples[j].Timestamp })
+	}
+	return series, nil
+}
+
+// rowLabels returns the sorted label set of a row
+func (r *Reader) rowLabels(name interface{}, bag interface{}) []prompb.Label {
+	f := &r.opts.Fields
+
+	// Fixed fields are not labels when flattened labels are read from pack_all()
+	fixed := make(map[string]struct{}, len(r.layout))
+	if f.Flatten {
+		for _, field := range r.layout {
+			fixed[field.Name] = struct{}{}
+		}
+	}
+
+	labels := []prompb.Label{{Name: model.MetricNameLabel, Value: fmt.Sprint(name)}}
+	if m, ok := bag.(map[string]interface{}); ok {
+		for key, v := range m {
+			label := key
+			if f.Flatten {
+				if _, ok := fixed[key]; ok || !strings.HasPrefix(key, f.Prefix) {
+					continue
+				}
+				label = strings.TrimPrefix(key, f.Prefix)
+			}
+
+			s, ok := v.(string)
+			if !ok {
+				if v == nil {
+					continue
+				}
+				s = fmt.Sprint(v)
+			}
+			if s == "" || label == model.MetricNameLabel {
+				continue
+			}
+			labels = append(labels, prompb.Label{Name: label, Value: s})
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// labelsKey returns a unique key of a sorted label set
+func labelsKey(labels []prompb.Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// timestampMs converts a datetime value into milliseconds since the Unix epoch
+func timestampMs(v interface{}) (int64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("adx timestamp %v is not a datetime", v)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("adx timestamp: %w", err)
+	}
+	return t.UnixMilli(), nil
+}
+
+// sampleValue converts a real value into a sample value
+//
+// Null values were NaN when written, stale ones staleness markers.
+func sampleValue(v interface{}, stale bool) (float64, error) {
+	switch n := v.(type) {
+	case nil:
+		if stale {
+			return math.Float64frombits(value.StaleNaN), nil
+		}
+		return math.NaN(), nil
+	case json.Number:
+		return n.Float64()
+	case string:
+		// Kusto encodes non-finite reals as strings
+		switch n {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+	}
+	return 0, fmt.Errorf("adx value %v is not a real", v)
+}
@@ -0,0 +1,329 @@
+package adx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+// kustoStandIn answers queries with the frames of respond, recording the query text
+type kustoStandIn struct {
+	*httptest.Server
+	queries []string
+}
+
+func newKustoStandIn(t *testing.T, respond func(w http.ResponseWriter, csl string)) *kustoStandIn {
+	t.Helper()
+	k := &kustoStandIn{}
+	k.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v2/rest/query" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		var body struct {
+			DB  string `json:"db"`
+			CSL string `json:"csl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.DB != "metrics" {
+			http.Error(w, `{"error":{"code":"BadRequest","message":"bad body"}}`, http.StatusBadRequest)
+			return
+		}
+		k.queries = append(k.queries, body.CSL)
+		respond(w, body.CSL)
+	}))
+	t.Cleanup(k.Close)
+	return k
+}
+
+// primaryResult writes a v2 query response with a single primary result
+func primaryResult(w http.ResponseWriter, columns []Column, rows [][]interface{}) {
+	json.NewEncoder(w).Encode([]interface{}{
+		map[string]interface{}{"FrameType": "DataSetHeader", "Version": "v2.0"},
+		map[string]interface{}{"FrameType": "DataTable", "TableKind": "QueryProperties", "Columns": []Column{}, "Rows": [][]interface{}{}},
+		map[string]interface{}{"FrameType": "DataTable", "TableKind": "PrimaryResult", "Columns": columns, "Rows": rows},
+		map[string]interface{}{"FrameType": "DataSetCompletion", "HasErrors": false},
+	})
+}
+
+var resultColumns = []Column{
+	{Name: timestampColumn, Type: "datetime"},
+	{Name: valueColumn, Type: "real"},
+	{Name: nameColumn, Type: "string"},
+	{Name: labelsColumn, Type: "dynamic"},
+	{Name: staleColumn, Type: "bool"},
+}
+
+func newTestReader(t *testing.T, endpoint, table string, stale record.Policy) *Reader {
+	t.Helper()
+	client, err := NewClient(&Config{Endpoint: endpoint, Database: "metrics", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewReader(client, &ReadConfig{
+		Routing: routing.Config{Table: table},
+		Record: record.Options{
+			Values: record.ValuePolicy{Stale: stale},
+			Fields: record.DefaultFields(),
+		},
+		MaxSamples: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+func TestQueryTable(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    string
+		matchers []*prompb.LabelMatcher
+		want     string
+		err      error
+	}{
+		{
+			name:     "metric name",
+			table:    routing.DefaultTable,
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+			want:     "['up']\n",
+		},
+		{
+			name:  "labels in template",
+			table: "{{ .Labels.job }}_{{ .Name }}",
+			matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+			},
+			want: "['node_up']\n",
+		},
+		{
+			name:     "regex name",
+			table:    routing.DefaultTable,
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "node_.*"}},
+			err:      ErrNameMatcher,
+		},
+		{
+			name:     "no name",
+			table:    routing.DefaultTable,
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"}},
+			err:      ErrNameMatcher,
+		},
+		{
+			name:     "regex name static table",
+			table:    "metrics",
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "node_.*"}},
+			want:     "['metrics']\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newTestReader(t, "https://cluster.example.com", tt.table, record.DefaultPolicy)
+			query, err := reader.Query(&prompb.Query{StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: tt.matchers})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Query() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !strings.HasPrefix(query, tt.want) {
+				t.Errorf("Query() = %q, want prefix %q", query, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMatchers(t *testing.T) {
+	reader := newTestReader(t, "https://cluster.example.com", routing.DefaultTable, record.DefaultPolicy)
+	query, err := reader.Query(&prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+			{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "host.*"},
+			{Type: prompb.LabelMatcher_NRE, Name: "env", Value: "dev|test"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"| where ['timestamp'] between (unixtime_milliseconds_todatetime(1000) .. unixtime_milliseconds_todatetime(2000))",
+		"| where ['name'] == 'up'",
+		"| where tostring(['labels']['job']) != 'node'",
+		"| where tostring(['labels']['instance']) matches regex '^(?:host.*)$'",
+		"| where not(tostring(['labels']['env']) matches regex '^(?:dev|test)$')",
+		"| take 4",
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query is missing %q:\n%s", want, query)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	kusto := newKustoStandIn(t, func(w http.ResponseWriter, csl string) {
+		primaryResult(w, resultColumns, [][]interface{}{
+			{"1970-01-01T00:00:02Z", 2.5, "up", map[string]interface{}{"job": "node"}, false},
+			{"1970-01-01T00:00:01Z", 1, "up", map[string]interface{}{"job": "node"}, false},
+			{"1970-01-01T00:00:01Z", nil, "up", map[string]interface{}{"job": "api", "empty": ""}, true},
+		})
+	})
+	reader := newTestReader(t, kusto.URL, routing.DefaultTable, record.FieldPolicy)
+
+	series, err := reader.Read(context.Background(), &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   3000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kusto.queries) != 1 || !strings.Contains(kusto.queries[0], staleColumn+" = ['stale']") {
+		t.Errorf("queries = %q, want a single query projecting the stale field", kusto.queries)
+	}
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want 2", len(series))
+	}
+
+	node := series[0]
+	if got := labelsKey(node.Labels); got != labelsKey([]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}) {
+		t.Errorf("labels = %v", node.Labels)
+	}
+	if len(node.Samples) != 2 || node.Samples[0].Timestamp != 1000 || node.Samples[0].Value != 1 || node.Samples[1].Value != 2.5 {
+		t.Errorf("samples = %v, want sorted samples 1 and 2.5", node.Samples)
+	}
+
+	api := series[1]
+	if len(api.Labels) != 2 {
+		t.Errorf("labels = %v, want empty labels omitted", api.Labels)
+	}
+	if len(api.Samples) != 1 || !value.IsStaleNaN(api.Samples[0].Value) {
+		t.Errorf("samples = %v, want a staleness marker", api.Samples)
+	}
+}
+
+func TestReadNaN(t *testing.T) {
+	kusto := newKustoStandIn(t, func(w http.ResponseWriter, csl string) {
+		primaryResult(w, resultColumns[:4], [][]interface{}{
+			{"1970-01-01T00:00:01Z", "NaN", "up", map[string]interface{}{}},
+			{"1970-01-01T00:00:02Z", "Infinity", "up", map[string]interface{}{}},
+			{"1970-01-01T00:00:03Z", nil, "up", map[string]interface{}{}},
+		})
+	})
+	reader := newTestReader(t, kusto.URL, routing.DefaultTable, record.DefaultPolicy)
+
+	series, err := reader.Read(context.Background(), &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Samples) != 3 {
+		t.Fatalf("series = %v, want one series of 3 samples", series)
+	}
+	samples := series[0].Samples
+	if !math.IsNaN(samples[0].Value) || !math.IsInf(samples[1].Value, 1) || !math.IsNaN(samples[2].Value) || value.IsStaleNaN(samples[2].Value) {
+		t.Errorf("samples = %v, want NaN, +Inf and NaN", samples)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	up := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}}
+
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, csl string)
+		want    string
+	}{
+		{
+			name: "http error",
+			respond: func(w http.ResponseWriter, csl string) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"code":"General_BadRequest","message":"Semantic error: 'up' could not be resolved"}}`))
+			},
+			want: "Semantic error: 'up' could not be resolved",
+		},
+		{
+			name: "query error",
+			respond: func(w http.ResponseWriter, csl string) {
+				json.NewEncoder(w).Encode([]interface{}{
+					map[string]interface{}{"FrameType": "DataSetHeader"},
+					map[string]interface{}{"FrameType": "DataSetCompletion", "HasErrors": true, "OneApiErrors": []interface{}{
+						map[string]interface{}{"error": map[string]interface{}{"message": "Query execution has exceeded the allowed limits"}},
+					}},
+				})
+			},
+			want: "adx query failed: Query execution has exceeded the allowed limits",
+		},
+		{
+			name: "no primary result",
+			respond: func(w http.ResponseWriter, csl string) {
+				w.Write([]byte(`[{"FrameType":"DataSetCompletion","HasErrors":false}]`))
+			},
+			want: "no primary result",
+		},
+		{
+			name: "missing columns",
+			respond: func(w http.ResponseWriter, csl string) {
+				primaryResult(w, resultColumns[:2], nil)
+			},
+			want: "missing columns",
+		},
+		{
+			name: "too many samples",
+			respond: func(w http.ResponseWriter, csl string) {
+				row := []interface{}{"1970-01-01T00:00:01Z", 1, "up", map[string]interface{}{}}
+				primaryResult(w, resultColumns[:4], [][]interface{}{row, row, row, row})
+			},
+			want: "more than 3 samples",
+		},
+		{
+			name: "not a real",
+			respond: func(w http.ResponseWriter, csl string) {
+				primaryResult(w, resultColumns[:4], [][]interface{}{{"1970-01-01T00:00:01Z", "one", "up", map[string]interface{}{}}})
+			},
+			want: "is not a real",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kusto := newKustoStandIn(t, tt.respond)
+			reader := newTestReader(t, kusto.URL, routing.DefaultTable, record.DefaultPolicy)
+
+			_, err := reader.Read(context.Background(), up)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Read() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Package cloudevents wraps serialized samples in a CloudEvents 1.0 envelope.
+//
+// See [ https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/spec.md ]
+package cloudevents
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v4/uuid"
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+)
+
+const (
+	// StructuredMode wraps the payload in a JSON CloudEvent.
+	StructuredMode = "structured"
+	// BinaryMode keeps the payload and adds the CloudEvent attributes as application properties,
+	// datacontenttype is the content-type message property.
+	BinaryMode = "binary"
+
+	// SpecVersion is the CloudEvents specification version.
+	SpecVersion = "1.0"
+	// ContentType is the MIME type of a structured mode CloudEvent.
+	ContentType = "application/cloudevents+json; charset=UTF-8"
+	// PropertyPrefix prefixes the CloudEvent attributes in AMQP binary mode.
+	//
+	// See [ https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/amqp-protocol-binding.md ]
+	PropertyPrefix = "cloudEvents:"
+	// KafkaHeaderPrefix prefixes the CloudEvent attributes in Kafka binary mode.
+	//
+	// See [ https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/kafka-protocol-binding.md ]
+	KafkaHeaderPrefix = "ce_"
+	// KafkaContentTypeHeader is the Kafka header of the content type in both modes.
+	KafkaContentTypeHeader = "content-type"
+
+	// DefaultSource is the source template used when none is configured.
+	DefaultSource = "/prometheus-eventhubs-adapter"
+	// DefaultType is the type template used when none is configured.
+	DefaultType = "io.prometheus.sample"
+	// DefaultSubject is the subject template used when none is configured.
+	DefaultSubject = "{{ .Name }}"
+)
+
+// Config for the CloudEvents envelope
+type Config struct {
+	// Mode is "structured" or "binary", empty disables the envelope.
+	Mode string
+	// Source is a template for the CloudEvent source attribute.
+	Source string
+	// Type is a template for the CloudEvent type attribute.
+	Type string
+	// Subject is a template for the CloudEvent subject attribute, empty omits the subject.
+	Subject string
+}
+
+// Enabled reports whether the envelope is configured.
+func (cfg *Config) Enabled() bool {
+	return cfg.Mode != ""
+}
+
+// Envelope wraps serialized samples as CloudEvents
+type Envelope struct {
+	structured bool
+	source     *routing.Template
+	eventType  *routing.Template
+	subject    *routing.Template
+}
+
+// New creates an Envelope from the configuration
+func New(cfg *Config) (*Envelope, error) {
+	env := &Envelope{}
+
+	switch strings.ToLower(cfg.Mode) {
+	case StructuredMode:
+		env.structured = true
+	case BinaryMode:
+	default:
+		return nil, fmt.Errorf("Unknown CloudEvents mode: '%s'", strings.ToLower(cfg.Mode))
+	}
+
+	var err error
+	if env.source, err = newTemplate("source", cfg.Source, DefaultSource); err != nil {
+		return nil, err
+	}
+	if env.eventType, err = newTemplate("type", cfg.Type, DefaultType); err != nil {
+		return nil, err
+	}
+	if cfg.Subject != "" {
+		if env.subject, err = routing.NewTemplate("subject", cfg.Subject); err != nil {
+			return nil, err
+		}
+	}
+
+	return env, nil
+}
+
+// newTemplate parses a template, using a default when text is empty
+func newTemplate(name, text, defaultText string) (*routing.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	return routing.NewTemplate(name, text)
+}
+
+// event is a structured mode CloudEvent
+type event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+// Wrap wraps a serialized sample
+//
+// returns the event body, its MIME type for the AMQP content-type message
+// property and, in binary mode, the CloudEvent attributes to add to the event
+// properties.
+func (e *Envelope) Wrap(sample *model.Sample, payload []byte, contentType string) ([]byte, string, map[string]interface{}, error) {
+	data := routing.NewData(sample.Metric)
+
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	id := uid.String()
+	source, err := e.source.Execute(data)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("cloudevents source: %w", err)
+	}
+	eventType, err := e.eventType.Execute(data)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("cloudevents type: %w", err)
+	}
+	var subject string
+	if e.subject != nil {
+		if subject, err = e.subject.Execute(data); err != nil {
+			return nil, "", nil, fmt.Errorf("cloudevents subject: %w", err)
+		}
+	}
+	eventTime := time.Unix(0, sample.Timestamp.UnixNano()).UTC().Format(time.RFC3339Nano)
+
+	if !e.structured {
+		props := map[string]interface{}{
+			PropertyPrefix + "specversion": SpecVersion,
+			PropertyPrefix + "id":          id,
+			PropertyPrefix + "source":      source,
+			PropertyPrefix + "type":        eventType,
+			PropertyPrefix + "time":        eventTime,
+		}
+		if subject != "" {
+			props[PropertyPrefix+"subject"] = subject
+		}
+		return payload, contentType, props, nil
+	}
+
+	ce := event{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            eventTime,
+		DataContentType: contentType,
+	}
+	if isJSON(contentType) {
+		ce.Data = payload
+	} else {
+		ce.DataBase64 = payload
+	}
+
+	body, err := json.Marshal(ce)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return body, ContentType, nil, nil
+}
+
+// isJSON reports whether a MIME type is JSON
+func isJSON(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,125 @@
+// Package compression compresses event bodies and marks them with a
+// Content-Encoding.
+package compression
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is an enum for the supported compression codecs.
+type Codec uint8
+
+const (
+	// NoCompression leaves the data unchanged.
+	NoCompression Codec = iota
+	// GzipCompression compresses with gzip (RFC 1952).
+	GzipCompression
+	// ZstdCompression compresses with Zstandard (RFC 8878).
+	ZstdCompression
+	// SnappyCompression compresses with the snappy block format.
+	SnappyCompression
+)
+
+const (
+	// ContentEncodingProperty is the event property holding the compression codec of the event data.
+	ContentEncodingProperty = "Content-Encoding"
+)
+
+// String returns the Content-Encoding value of the codec
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "identity"
+	case GzipCompression:
+		return "gzip"
+	case ZstdCompression:
+		return "zstd"
+	case SnappyCompression:
+		return "snappy"
+	default:
+		return ""
+	}
+}
+
+// ParseCodec converts a codec string into a Codec value.
+// returns an error if the input string does not match known values.
+func ParseCodec(codecStr string) (Codec, error) {
+	switch strings.ToLower(codecStr) {
+	case "", "none", "identity":
+		return NoCompression, nil
+	case "gzip":
+		return GzipCompression, nil
+	case "zstd":
+		return ZstdCompression, nil
+	case "snappy":
+		return SnappyCompression, nil
+	default:
+		return NoCompression, fmt.Errorf("Unknown compression: '%s'", strings.ToLower(codecStr))
+	}
+}
+
+// IsADX reports whether Azure Data Explorer can ingest data compressed with the codec.
+//
+// Event Hubs data connections only decompress gzip.
+func (c Codec) IsADX() bool {
+	return c == NoCompression || c == GzipCompression
+}
+
+// gzipWriters reuses gzip writers, which allocate large buffers.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// zstdEncoder is safe for concurrent use with EncodeAll.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// Compress returns the data compressed with the codec
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case GzipCompression:
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ZstdCompression:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case SnappyCompression:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", c)
+	}
+}
@@ -0,0 +1,111 @@
+package compression
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrTooLarge is returned when the decompressed data exceeds the size limit.
+	ErrTooLarge = errors.New("decompressed size exceeds limit")
+	// ErrUnsupported is returned for an unknown Content-Encoding.
+	ErrUnsupported = errors.New("unsupported content encoding")
+)
+
+// snappyStreamMagic starts every snappy framed stream.
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// Decode decompresses data with the codec named by a Content-Encoding header
+//
+// An empty encoding is treated as snappy, the Prometheus remote write default.
+// Snappy data is accepted in both block and framed format. limit is the
+// maximum decompressed size in bytes, 0 disables the limit.
+func Decode(encoding string, data []byte, limit int) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "snappy":
+		if bytes.HasPrefix(data, snappyStreamMagic) {
+			return readAll(snappy.NewReader(bytes.NewReader(data)), limit)
+		}
+		return decodeSnappyBlock(data, limit)
+	case "identity":
+		if limit > 0 && len(data) > limit {
+			return nil, ErrTooLarge
+		}
+		return data, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readAll(zr, limit)
+	case "zstd":
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if limit > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(limit)+1))
+		}
+		zr, err := zstd.NewReader(bytes.NewReader(data), opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		buf, err := readAll(zr, limit)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+		return buf, err
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnsupported, encoding)
+	}
+}
+
+// decodeSnappyBlock decodes snappy block data, checking the decoded length before allocating.
+func decodeSnappyBlock(data []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && n > limit {
+		return nil, ErrTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
+
+// readAll reads r to the end, failing once more than limit bytes are read.
+func readAll(r io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, ErrTooLarge
+	}
+	return buf, nil
+}
@@ -0,0 +1,162 @@
+package compression
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	bombSize = 4 << 20
+	limit    = 64 << 10
+)
+
+// snappyFramed compresses data in the snappy framed format
+func snappyFramed(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipped compresses data with gzip
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zstdFrameHeader returns a single segment zstd frame header claiming contentSize bytes, without blocks
+func zstdFrameHeader(contentSize uint64) []byte {
+	header := []byte{0x28, 0xb5, 0x2f, 0xfd, 0xe0}
+	return binary.LittleEndian.AppendUint64(header, contentSize)
+}
+
+// zstdStream compresses data as a zstd frame without a content size, as streaming encoders write it
+func zstdStream(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf, zstd.WithWindowSize(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	zeros := make([]byte, bombSize)
+	small := bytes.Repeat([]byte("sample "), 100)
+	// Block header claiming 1 GiB, followed by no data
+	snappyHeader := binary.AppendUvarint(nil, 1<<30)
+
+	tests := []struct {
+		name     string
+		encoding string
+		data     []byte
+		limit    int
+		want     []byte
+		wantErr  error
+	}{
+		{name: "snappy block", encoding: "snappy", data: snappy.Encode(nil, small), limit: limit, want: small},
+		{name: "snappy default encoding", data: snappy.Encode(nil, small), limit: limit, want: small},
+		{name: "snappy block bomb", encoding: "snappy", data: snappy.Encode(nil, zeros), limit: limit, wantErr: ErrTooLarge},
+		// Rejected from the header, before allocating the claimed length
+		{name: "snappy block header claiming 1 GiB", encoding: "snappy", data: snappyHeader, limit: limit, wantErr: ErrTooLarge},
+		{name: "snappy framed", encoding: "snappy", data: snappyFramed(t, small), limit: limit, want: small},
+		{name: "snappy framed bomb", encoding: "snappy", data: snappyFramed(t, zeros), limit: limit, wantErr: ErrTooLarge},
+		{name: "gzip", encoding: "gzip", data: gzipped(t, small), limit: limit, want: small},
+		{name: "gzip bomb", encoding: "x-gzip", data: gzipped(t, zeros), limit: limit, wantErr: ErrTooLarge},
+		{name: "gzip bomb without limit", encoding: "gzip", data: gzipped(t, zeros), want: zeros},
+		{name: "zstd", encoding: "zstd", data: zstdEncoder.EncodeAll(small, nil), limit: limit, want: small},
+		// The frame content size is over the decoder memory cap
+		{name: "zstd bomb", encoding: "zstd", data: zstdEncoder.EncodeAll(zeros, nil), limit: limit, wantErr: ErrTooLarge},
+		// Rejected from the header by the memory cap, before reading blocks
+		{name: "zstd frame header claiming 256 MiB", encoding: "zstd", data: zstdFrameHeader(256 << 20), limit: limit, wantErr: ErrTooLarge},
+		// Without a content size the stream is stopped by the read limit
+		{name: "zstd stream bomb", encoding: "zstd", data: zstdStream(t, zeros), limit: limit, wantErr: ErrTooLarge},
+		{name: "identity at limit", encoding: "identity", data: small, limit: len(small), want: small},
+		{name: "identity over limit", encoding: "identity", data: small, limit: len(small) - 1, wantErr: ErrTooLarge},
+		{name: "unsupported", encoding: "br", data: small, limit: limit, wantErr: ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.encoding, tt.data, tt.limit)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestReadAllStopsAtLimit(t *testing.T) {
+	r := &countingReader{r: bytes.NewReader(make([]byte, bombSize))}
+	if _, err := readAll(r, limit); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("error = %v, want %v", err, ErrTooLarge)
+	}
+	// The rest of a decompression bomb is never inflated
+	if r.n > limit+1 {
+		t.Errorf("read %d bytes, want at most %d", r.n, limit+1)
+	}
+}
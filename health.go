@@ -0,0 +1,255 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/redact"
+)
+
+const (
+	// healthyPath is the path of the liveness endpoint.
+	healthyPath = "/-/healthy"
+	// readyPath is the path of the readiness endpoint.
+	readyPath = "/-/ready"
+
+	// checkPass and checkFail are the status of a readiness check.
+	checkPass = "pass"
+	checkFail = "fail"
+
+	// staleChecks is the number of check intervals after which the last successful connection is too old.
+	staleChecks = 3
+)
+
+// pinger is implemented by writers which can check the connection to their destination
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// healthState tracks the state reported by the readiness endpoint
+type healthState struct {
+	// writes is the number of writes in progress.
+	writes atomic.Int64
+	// shutdown is set once the adapter is shutting down.
+	shutdown atomic.Bool
+
+	// configured signals the monitor that the check settings changed.
+	configured chan struct{}
+
+	mu          sync.Mutex
+	interval    time.Duration
+	timeout     time.Duration
+	maxWrites   int64
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastErr     error
+}
+
+// health is the state of the adapter reported by the readiness endpoint.
+var health = &healthState{configured: make(chan struct{}, 1)}
+
+// check is the result of a readiness check
+type check struct {
+	Status  string                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// configure sets the connection check interval and timeout and the limit of writes in progress, 0 disables either
+//
+// Called at startup and on each configuration reload.
+func (h *healthState) configure(interval, timeout time.Duration, maxWrites int) {
+	h.mu.Lock()
+	changed := interval != h.interval || timeout != h.timeout
+	h.interval = interval
+	h.timeout = timeout
+	h.maxWrites = int64(maxWrites)
+	h.mu.Unlock()
+
+	if changed {
+		select {
+		case h.configured <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkSettings returns the connection check interval and timeout
+func (h *healthState) checkSettings() (time.Duration, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.interval, h.timeout
+}
+
+// connected records a successful connection to the destination
+func (h *healthState) connected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = time.Now()
+}
+
+// failed records a failed connection to the destination
+func (h *healthState) failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastFailure = time.Now()
+	h.lastErr = err
+}
+
+// monitor checks the connection of the writer at start and every interval, until the context is done
+//
+// A changed interval starts a new check right away, checks pause while disabled.
+func (h *healthState) monitor(ctx context.Context, w writer) {
+	p, ok := w.(pinger)
+	if !ok {
+		return
+	}
+
+	for {
+		var (
+			timer *time.Timer
+			next  <-chan time.Time
+		)
+		if interval, timeout := h.checkSettings(); interval > 0 {
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := p.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				log.ErrorObj(err).Str("writer", w.Name()).Msg("Connection check failed")
+				h.failed(err)
+			} else {
+				h.connected()
+			}
+
+			timer = time.NewTimer(interval)
+			next = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-next:
+		case <-h.configured:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// connectionCheck passes when the last connection to the destination, by a check or a write, succeeded recently
+func (h *healthState) connectionCheck() check {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := check{Status: checkPass, Details: map[string]interface{}{}}
+	if !h.lastSuccess.IsZero() {
+		c.Details["last_success"] = h.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	if !h.lastFailure.IsZero() {
+		c.Details["last_failure"] = h.lastFailure.UTC().Format(time.RFC3339)
+		c.Details["last_error"] = redact.String(h.lastErr.Error())
+	}
+
+	switch {
+	case h.interval <= 0:
+		c.Message = "connection checks disabled"
+	case h.lastSuccess.IsZero():
+		c.Status, c.Message = checkFail, "no successful connection"
+	case h.lastFailure.After(h.lastSuccess):
+		c.Status, c.Message = checkFail, "last connection failed"
+	case time.Since(h.lastSuccess) > staleChecks*h.interval:
+		c.Status, c.Message = checkFail, fmt.Sprintf("no successful connection in %s", staleChecks*h.interval)
+	}
+	return c
+}
+
+// saturationCheck passes while the writes in progress are below the limit
+func (h *healthState) saturationCheck() check {
+	h.mu.Lock()
+	maxWrites := h.maxWrites
+	h.mu.Unlock()
+
+	writes := h.writes.Load()
+	c := check{Status: checkPass, Details: map[string]interface{}{"writes_in_progress": writes}}
+	if maxWrites > 0 {
+		c.Details["max_writes_in_progress"] = maxWrites
+		if writes >= maxWrites {
+			c.Status, c.Message = checkFail, "too many writes in progress"
+		}
+	}
+	return c
+}
+
+// shutdownCheck passes until the adapter is shutting down
+func (h *healthState) shutdownCheck() check {
+	if h.shutdown.Load() {
+		return check{Status: checkFail, Message: "shutting down"}
+	}
+	return check{Status: checkPass}
+}
+
+// healthyHandler responds while the adapter serves requests, for liveness probes
+func healthyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+	}
+}
+
+// checks runs the readiness checks, by name
+func (h *healthState) checks() map[string]check {
+	return map[string]check{
+		"connection": h.connectionCheck(),
+		"saturation": h.saturationCheck(),
+		"shutdown":   h.shutdownCheck(),
+	}
+}
+
+// ready returns true when every check passed
+func ready(checks map[string]check) bool {
+	for _, result := range checks {
+		if result.Status != checkPass {
+			return false
+		}
+	}
+	return true
+}
+
+// readyHandler responds whether the adapter is ready to accept writes, for readiness probes
+//
+// Responds 503 Service Unavailable when any check fails, with the detail of each check.
+func readyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		checks := health.checks()
+		if !ready(checks) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+	}
+}
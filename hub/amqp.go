@@ -0,0 +1,369 @@
+package hub
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v4/auth"
+	"github.com/Azure/azure-amqp-common-go/v4/cbs"
+	"github.com/Azure/azure-amqp-common-go/v4/rpc"
+	"github.com/Azure/azure-amqp-common-go/v4/uuid"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// claimRefresh is how long a claim is used before it is negotiated again,
+	// below the lifetime of SAS and Azure Active Directory tokens.
+	claimRefresh = 30 * time.Minute
+
+	// batchMessageFormat is the AMQP message format of an event batch.
+	batchMessageFormat uint32 = 0x80013700
+	// batchMessageOverhead is reserved in a batch for the batch message and the data section of each event.
+	batchMessageOverhead = 100
+	// partitionKeyAnnotation is the message annotation holding the partition key.
+	partitionKeyAnnotation = "x-opt-partition-key"
+	// managementAddress is the address of the AMQP management node.
+	managementAddress = "$management"
+)
+
+// hubSender sends events to an Event Hub
+type hubSender interface {
+	Send(ctx context.Context, event *eventhub.Event) error
+	SendBatch(ctx context.Context, events []*eventhub.Event) error
+	GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error)
+	Close(ctx context.Context) error
+}
+
+// libraryHub sends events using the connections of the eventhub library
+type libraryHub struct {
+	hub *eventhub.Hub
+}
+
+func (h *libraryHub) Send(ctx context.Context, event *eventhub.Event) error {
+	return h.hub.Send(ctx, event)
+}
+
+func (h *libraryHub) SendBatch(ctx context.Context, events []*eventhub.Event) error {
+	return h.hub.SendBatch(ctx, eventhub.NewEventBatchIterator(events...))
+}
+
+func (h *libraryHub) GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error) {
+	return h.hub.GetRuntimeInformation(ctx)
+}
+
+func (h *libraryHub) Close(ctx context.Context) error {
+	return h.hub.Close(ctx)
+}
+
+// amqpHub sends events over connections opened by the adapter
+//
+// The eventhub library dials its connections itself, without a proxy, custom
+// endpoint or TLS settings, and sends no message properties. amqpHub
+// implements the sending side of an Event Hub on the same AMQP client, with a
+// dialer of its own, for these settings only.
+type amqpHub struct {
+	host     string
+	name     string
+	provider auth.TokenProvider
+	dialer   *dialer
+
+	mu      sync.Mutex
+	conn    *amqp.Conn
+	sender  *amqp.Sender
+	claimed time.Time
+}
+
+// newAMQPHub creates a hub sending to the Event Hub name of a namespace host
+func newAMQPHub(host, name string, provider auth.TokenProvider, cfg *TransportConfig) (*amqpHub, error) {
+	d, err := newDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpHub{host: host, name: name, provider: provider, dialer: d}, nil
+}
+
+// audience returns the claim audience of the hub
+func (h *amqpHub) audience() string {
+	return "amqps://" + h.host + "/" + h.name
+}
+
+// link returns the sender link, connecting or negotiating a new claim when needed
+func (h *amqpHub) link(ctx context.Context) (*amqp.Conn, *amqp.Sender, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn != nil && time.Since(h.claimed) > claimRefresh {
+		if err := cbs.NegotiateClaim(ctx, h.audience(), h.conn, h.provider); err != nil {
+			h.closeLocked()
+		} else {
+			h.claimed = time.Now()
+		}
+	}
+	if h.conn != nil {
+		return h.conn, h.sender, nil
+	}
+
+	nc, err := h.dialer.dial(ctx, h.host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := amqp.NewConn(ctx, nc, &amqp.ConnOptions{
+		HostName: h.host,
+		SASLType: amqp.SASLTypeAnonymous(),
+		Properties: map[string]any{
+			"product":   "prometheus-eventhubs-adapter",
+			"platform":  runtime.GOOS,
+			"framework": runtime.Version(),
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cbs.NegotiateClaim(ctx, h.audience(), conn, h.provider); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("negotiate claim: %w", err)
+	}
+	claimed := time.Now()
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	sender, err := session.NewSender(ctx, h.name, &amqp.SenderOptions{
+		SettlementMode:              amqp.SenderSettleModeMixed.Ptr(),
+		RequestedReceiverSettleMode: amqp.ReceiverSettleModeFirst.Ptr(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	h.conn, h.sender, h.claimed = conn, sender, claimed
+	return conn, sender, nil
+}
+
+// reset closes the connection of a failed sender link, the next send reconnects
+func (h *amqpHub) reset(sender *amqp.Sender) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sender == sender {
+		h.closeLocked()
+	}
+}
+
+func (h *amqpHub) closeLocked() error {
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn, h.sender = nil, nil
+	return err
+}
+
+// send sends a message, reconnecting once when the connection failed
+func (h *amqpHub) send(ctx context.Context, msg *amqp.Message) error {
+	for attempt := 0; ; attempt++ {
+		_, sender, err := h.link(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = sender.Send(ctx, msg, nil)
+		if err == nil || attempt > 0 || !recoverable(err) {
+			return err
+		}
+		h.reset(sender)
+	}
+}
+
+// recoverable reports whether a new connection may resolve a send error
+func recoverable(err error) bool {
+	var connErr *amqp.ConnError
+	var sessionErr *amqp.SessionError
+	var linkErr *amqp.LinkError
+	return errors.As(err, &connErr) || errors.As(err, &sessionErr) || errors.As(err, &linkErr)
+}
+
+// Send sends a single event
+func (h *amqpHub) Send(ctx context.Context, event *eventhub.Event) error {
+	msg, err := eventMessage(event)
+	if err != nil {
+		return err
+	}
+	return h.send(ctx, msg)
+}
+
+// SendBatch sends events in as few batch messages as the message size allows
+//
+// Events are batched per partition key, like the eventhub library.
+func (h *amqpHub) SendBatch(ctx context.Context, events []*eventhub.Event) error {
+	_, sender, err := h.link(ctx)
+	if err != nil {
+		return err
+	}
+	maxSize := int(sender.MaxMessageSize())
+	if maxSize <= 0 || maxSize > int(eventhub.DefaultMaxMessageSizeInBytes) {
+		maxSize = int(eventhub.DefaultMaxMessageSizeInBytes)
+	}
+
+	var keys []string
+	groups := make(map[string][]*eventhub.Event)
+	for _, event := range events {
+		key := ""
+		if event.PartitionKey != nil {
+			key = *event.PartitionKey
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], event)
+	}
+
+	for _, key := range keys {
+		batch, size := [][]byte{}, batchMessageOverhead
+		for _, event := range groups[key] {
+			msg, err := eventMessage(event)
+			if err != nil {
+				return err
+			}
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				return err
+			}
+
+			if len(batch) > 0 && size+len(data)+5 > maxSize {
+				if err := h.send(ctx, batchMessage(batch, key)); err != nil {
+					return err
+				}
+				batch, size = [][]byte{}, batchMessageOverhead
+			}
+			batch = append(batch, data)
+			size += len(data) + 5
+		}
+		if err := h.send(ctx, batchMessage(batch, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventMessage converts an event into its AMQP message
+//
+// The content type of the event is read from its raw AMQP message properties.
+func eventMessage(event *eventhub.Event) (*amqp.Message, error) {
+	id := event.ID
+	if id == "" {
+		uid, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		id = uid.String()
+	}
+
+	msg := amqp.NewMessage(event.Data)
+	msg.Properties = &amqp.MessageProperties{MessageID: id}
+	if contentType := event.RawAMQPMessage.Properties.ContentType; contentType != "" {
+		msg.Properties.ContentType = &contentType
+	}
+	if len(event.Properties) > 0 {
+		msg.ApplicationProperties = make(map[string]any, len(event.Properties))
+		for name, value := range event.Properties {
+			msg.ApplicationProperties[name] = value
+		}
+	}
+	if event.PartitionKey != nil {
+		msg.Annotations = amqp.Annotations{partitionKeyAnnotation: *event.PartitionKey}
+	}
+	return msg, nil
+}
+
+// batchMessage wraps encoded event messages into a batch message
+func batchMessage(data [][]byte, partitionKey string) *amqp.Message {
+	msg := &amqp.Message{
+		Data:   data,
+		Format: batchMessageFormat,
+	}
+	if partitionKey != "" {
+		msg.Annotations = amqp.Annotations{partitionKeyAnnotation: partitionKey}
+	}
+	return msg
+}
+
+// GetRuntimeInformation requests the runtime information of the hub from the management node
+func (h *amqpHub) GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error) {
+	conn, _, err := h.link(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := rpc.NewLink(ctx, conn, managementAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer link.Close(ctx)
+
+	token, err := h.provider.GetToken(h.audience())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := link.RetryableRPC(ctx, 3, time.Second, &amqp.Message{
+		ApplicationProperties: map[string]any{
+			"operation":      "READ",
+			"type":           eventhub.MsftVendor + ":eventhub",
+			"name":           h.name,
+			"security_token": token.Token,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := res.Message.Value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected runtime information %T", res.Message.Value)
+	}
+
+	info := &eventhub.HubRuntimeInformation{}
+	info.Path, _ = values["name"].(string)
+	info.CreatedAt, _ = values["created_at"].(time.Time)
+	if count, ok := values["partition_count"].(int32); ok {
+		info.PartitionCount = int(count)
+	}
+	info.PartitionIDs, _ = values["partition_ids"].([]string)
+	if info.Path == "" {
+		info.Path = h.name
+	}
+	return info, nil
+}
+
+// Close closes the connection
+func (h *amqpHub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closeLocked()
+}
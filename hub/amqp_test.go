@@ -0,0 +1,1016 @@
+package hub
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/v4/sas"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/go-amqp"
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+const (
+	testNamespace = "test.servicebus.windows.net"
+	testHub       = "hub"
+	testAudience  = "amqps://" + testNamespace + "/" + testHub
+	testConnStr   = "Endpoint=sb://" + testNamespace + "/;SharedAccessKeyName=RootManageSharedAccessKey;SharedAccessKey=fluffypuppy;EntityPath=" + testHub
+)
+
+// Descriptors of the AMQP 1.0 frames and types handled by the stand-in
+const (
+	saslMechanisms     uint64 = 0x40
+	saslInit           uint64 = 0x41
+	saslOutcome        uint64 = 0x44
+	performOpen        uint64 = 0x10
+	performBegin       uint64 = 0x11
+	performAttach      uint64 = 0x12
+	performFlow        uint64 = 0x13
+	performTransfer    uint64 = 0x14
+	performDisposition uint64 = 0x15
+	performDetach      uint64 = 0x16
+	performEnd         uint64 = 0x17
+	performClose       uint64 = 0x18
+	amqpErrorType      uint64 = 0x1d
+	stateAccepted      uint64 = 0x24
+	stateRejected      uint64 = 0x25
+	sourceType         uint64 = 0x28
+	targetType         uint64 = 0x29
+)
+
+// cbsAddress is the address of the claims based security node.
+const cbsAddress = "$cbs"
+
+var (
+	saslHeader = []byte("AMQP\x03\x01\x00\x00")
+	amqpHeader = []byte("AMQP\x00\x01\x00\x00")
+)
+
+// symbol is an AMQP symbol, encoded apart from strings
+type symbol string
+
+// described is an AMQP described type, such as a performative and its list of fields
+type described struct {
+	code  uint64
+	value any
+}
+
+// field returns a field of a described list, nil when absent
+func (d described) field(i int) any {
+	fields, _ := d.value.([]any)
+	if i >= len(fields) {
+		return nil
+	}
+	return fields[i]
+}
+
+// address returns the address of a source or target
+func address(v any) string {
+	d, _ := v.(described)
+	s, _ := d.field(0).(string)
+	return s
+}
+
+// decode reads an AMQP value
+//
+// Decodes the types of the performatives go-amqp sends. Messages are decoded by go-amqp.
+func decode(r *bytes.Reader) (any, error) {
+	code, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if code != 0x00 {
+		return decodeValue(code, r)
+	}
+
+	descriptor, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	value, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	// Symbolic descriptors are not used by the performatives and keep code 0
+	code64, _ := descriptor.(uint64)
+	return described{code: code64, value: value}, nil
+}
+
+func decodeValue(code byte, r *bytes.Reader) (any, error) {
+	switch code {
+	case 0x40:
+		return nil, nil
+	case 0x41:
+		return true, nil
+	case 0x42:
+		return false, nil
+	case 0x43:
+		return uint32(0), nil
+	case 0x44:
+		return uint64(0), nil
+	case 0x45:
+		return []any{}, nil
+	}
+
+	// Fixed width types
+	widths := map[byte]int{0x50: 1, 0x51: 1, 0x52: 1, 0x53: 1, 0x54: 1, 0x55: 1, 0x56: 1, 0x60: 2, 0x61: 2, 0x70: 4, 0x71: 4, 0x72: 4, 0x80: 8, 0x81: 8, 0x82: 8, 0x83: 8, 0x98: 16}
+	if width, ok := widths[code]; ok {
+		b := make([]byte, width)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		switch code {
+		case 0x50:
+			return b[0], nil
+		case 0x51:
+			return int8(b[0]), nil
+		case 0x52:
+			return uint32(b[0]), nil
+		case 0x53:
+			return uint64(b[0]), nil
+		case 0x54:
+			return int32(int8(b[0])), nil
+		case 0x55:
+			return int64(int8(b[0])), nil
+		case 0x56:
+			return b[0] != 0, nil
+		case 0x60:
+			return binary.BigEndian.Uint16(b), nil
+		case 0x61:
+			return int16(binary.BigEndian.Uint16(b)), nil
+		case 0x70, 0x72:
+			return binary.BigEndian.Uint32(b), nil
+		case 0x71:
+			return int32(binary.BigEndian.Uint32(b)), nil
+		case 0x80, 0x82:
+			return binary.BigEndian.Uint64(b), nil
+		case 0x81:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		case 0x83:
+			return time.UnixMilli(int64(binary.BigEndian.Uint64(b))), nil
+		default:
+			return [16]byte(b), nil
+		}
+	}
+
+	// Variable width and compound types, 0xb0, 0xd0 and 0xf0 with 4 byte sizes
+	wide := code&0x10 != 0
+	size, err := readLength(r, wide)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 0xa0, 0xb0, 0xa1, 0xb1, 0xa3, 0xb3:
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		switch code {
+		case 0xa0, 0xb0:
+			return b, nil
+		case 0xa1, 0xb1:
+			return string(b), nil
+		default:
+			return symbol(b), nil
+		}
+	case 0xc0, 0xd0, 0xc1, 0xd1, 0xe0, 0xf0:
+		count, err := readLength(r, wide)
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case 0xc0, 0xd0:
+			list := make([]any, count)
+			for i := range list {
+				if list[i], err = decode(r); err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		case 0xc1, 0xd1:
+			m := make(map[any]any, count/2)
+			for i := 0; i < count/2; i++ {
+				key, err := decode(r)
+				if err != nil {
+					return nil, err
+				}
+				if m[key], err = decode(r); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		default:
+			elementCode, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			array := make([]any, count)
+			for i := range array {
+				if array[i], err = decodeValue(elementCode, r); err != nil {
+					return nil, err
+				}
+			}
+			return array, nil
+		}
+	}
+	return nil, fmt.Errorf("stand-in can't decode type 0x%02x", code)
+}
+
+func readLength(r *bytes.Reader, wide bool) (int, error) {
+	if !wide {
+		b, err := r.ReadByte()
+		return int(b), err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// encode writes an AMQP value of the types the stand-in replies with
+func encode(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0x40)
+	case bool:
+		if v {
+			buf.WriteByte(0x41)
+		} else {
+			buf.WriteByte(0x42)
+		}
+	case uint8:
+		buf.Write([]byte{0x50, v})
+	case uint16:
+		buf.WriteByte(0x60)
+		buf.Write(binary.BigEndian.AppendUint16(nil, v))
+	case uint32:
+		buf.WriteByte(0x70)
+		buf.Write(binary.BigEndian.AppendUint32(nil, v))
+	case uint64:
+		buf.WriteByte(0x80)
+		buf.Write(binary.BigEndian.AppendUint64(nil, v))
+	case []byte:
+		buf.WriteByte(0xb0)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.Write(v)
+	case string:
+		buf.WriteByte(0xb1)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.WriteString(v)
+	case symbol:
+		buf.WriteByte(0xb3)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.WriteString(string(v))
+	case []symbol:
+		var elements bytes.Buffer
+		for _, s := range v {
+			elements.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s))))
+			elements.WriteString(string(s))
+		}
+		buf.WriteByte(0xf0)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(5+elements.Len())))
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.WriteByte(0xb3)
+		buf.Write(elements.Bytes())
+	case []any:
+		var items bytes.Buffer
+		for _, item := range v {
+			encode(&items, item)
+		}
+		buf.WriteByte(0xd0)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(4+items.Len())))
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.Write(items.Bytes())
+	case described:
+		// go-amqp parses descriptors of the small ulong encoding only
+		buf.Write([]byte{0x00, 0x53, byte(v.code)})
+		encode(buf, v.value)
+	default:
+		panic(fmt.Sprintf("stand-in can't encode %T", v))
+	}
+}
+
+// readFrame reads the channel and body of a frame, skipping empty heartbeat frames
+func readFrame(r io.Reader) (uint16, []byte, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, nil, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		offset := int(header[4]) * 4
+		if size < 8 || offset < 8 || offset > int(size) {
+			return 0, nil, fmt.Errorf("invalid frame header %x", header)
+		}
+		frame := make([]byte, size-8)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return 0, nil, err
+		}
+		if body := frame[offset-8:]; len(body) > 0 {
+			return binary.BigEndian.Uint16(header[6:]), body, nil
+		}
+	}
+}
+
+// writeFrame writes a frame of a performative and its payload
+func writeFrame(w io.Writer, frameType byte, channel uint16, performative described, payload []byte) error {
+	var body bytes.Buffer
+	encode(&body, performative)
+	body.Write(payload)
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(8+body.Len()))
+	frame = append(frame, 2, frameType)
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	_, err := w.Write(append(frame, body.Bytes()...))
+	return err
+}
+
+// hubTransfer is an event message received by the stand-in
+type hubTransfer struct {
+	format uint32
+	size   int
+	msg    *amqp.Message
+}
+
+// hubStandIn is a local AMQP 1.0 endpoint of an Event Hub
+//
+// Implements the performatives, claims based security and management requests
+// sent by amqpHub, without TLS and with anonymous SASL.
+type hubStandIn struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// claimStatus is the status code of put-token responses
+	claimStatus int32
+	// reject is the error condition of rejected events, events are accepted when empty
+	reject string
+	// drops is the number of events answered by closing the connection
+	drops int
+	// maxMessageSize of the event link, unlimited when 0
+	maxMessageSize uint64
+	conns          []net.Conn
+	claims         []*amqp.Message
+	requests       []*amqp.Message
+	transfers      []hubTransfer
+}
+
+func newHubStandIn(t *testing.T) *hubStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &hubStandIn{listener: listener, claimStatus: 202}
+	t.Cleanup(s.close)
+
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, nc)
+			s.mu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *hubStandIn) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+}
+
+// transport returns the transport settings connecting to the stand-in
+func (s *hubStandIn) transport() TransportConfig {
+	return TransportConfig{Endpoint: s.listener.Addr().String(), DisableTLS: true}
+}
+
+func (s *hubStandIn) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *hubStandIn) received() []hubTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]hubTransfer(nil), s.transfers...)
+}
+
+// standInLink is a link attached to the stand-in
+type standInLink struct {
+	handle uint32
+	// receiving is true for the links the client sends on
+	receiving bool
+	// address is the target of receiving links and the source of sending links
+	address string
+	// replyTo is the target of sending links, the reply address of requests
+	replyTo       string
+	credit        uint32
+	deliveryCount uint32
+	pending       []*amqp.Message
+
+	// delivery in progress, spanning transfer frames
+	deliveryID uint32
+	settled    bool
+	format     uint32
+	data       []byte
+}
+
+// standInSession is a session of a connection to the stand-in
+type standInSession struct {
+	channel      uint16
+	nextIncoming uint32
+	nextOutgoing uint32
+	links        map[uint32]*standInLink
+}
+
+// serve handles the frames of a connection until it is closed
+func (s *hubStandIn) serve(nc net.Conn) {
+	defer nc.Close()
+	if err := s.handshake(nc); err != nil {
+		return
+	}
+
+	sessions := make(map[uint16]*standInSession)
+	for {
+		channel, body, err := readFrame(nc)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(body)
+		v, err := decode(r)
+		perf, ok := v.(described)
+		if err != nil || !ok {
+			return
+		}
+		payload := body[len(body)-r.Len():]
+
+		switch perf.code {
+		case performOpen:
+			err = writeFrame(nc, 0, 0, described{performOpen, []any{"hub-stand-in", nil, uint32(65536), uint16(255)}}, nil)
+		case performBegin:
+			next, _ := perf.field(1).(uint32)
+			sessions[channel] = &standInSession{channel: channel, nextIncoming: next, links: make(map[uint32]*standInLink)}
+			err = writeFrame(nc, 0, channel, described{performBegin, []any{channel, uint32(0), uint32(5000), uint32(5000)}}, nil)
+		case performAttach:
+			err = s.attach(nc, sessions[channel], perf)
+		case performFlow:
+			err = s.flow(nc, sessions[channel], perf)
+		case performTransfer:
+			var drop bool
+			drop, err = s.transfer(nc, sessions[channel], perf, payload)
+			if drop {
+				return
+			}
+		case performDetach:
+			delete(sessions[channel].links, perf.field(0).(uint32))
+			err = writeFrame(nc, 0, channel, described{performDetach, []any{perf.field(0), true}}, nil)
+		case performEnd:
+			delete(sessions, channel)
+			err = writeFrame(nc, 0, channel, described{performEnd, []any{}}, nil)
+		case performClose:
+			writeFrame(nc, 0, 0, described{performClose, []any{}}, nil)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handshake negotiates anonymous SASL and the AMQP protocol
+func (s *hubStandIn) handshake(nc net.Conn) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(nc, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, saslHeader) {
+		return fmt.Errorf("unexpected protocol header %q", header)
+	}
+	nc.Write(saslHeader)
+	if err := writeFrame(nc, 1, 0, described{saslMechanisms, []any{[]symbol{"ANONYMOUS"}}}, nil); err != nil {
+		return err
+	}
+	_, body, err := readFrame(nc)
+	if err != nil {
+		return err
+	}
+	v, _ := decode(bytes.NewReader(body))
+	if frame, ok := v.(described); !ok || frame.code != saslInit {
+		return fmt.Errorf("unexpected SASL frame %v", v)
+	}
+	if err := writeFrame(nc, 1, 0, described{saslOutcome, []any{uint8(0)}}, nil); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(nc, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, amqpHeader) {
+		return fmt.Errorf("unexpected protocol header %q", header)
+	}
+	_, err = nc.Write(amqpHeader)
+	return err
+}
+
+// attach accepts a link, granting credit to the links the client sends on
+func (s *hubStandIn) attach(nc net.Conn, session *standInSession, perf described) error {
+	handle, _ := perf.field(1).(uint32)
+	// The role is true when the client is the receiver
+	role, _ := perf.field(2).(bool)
+	source, target := address(perf.field(5)), address(perf.field(6))
+
+	link := &standInLink{handle: handle, receiving: !role, address: target}
+	var initialDeliveryCount, maxMessageSize any
+	if role {
+		link.address, link.replyTo = source, target
+		initialDeliveryCount = uint32(0)
+	} else if target != cbsAddress && target != managementAddress {
+		s.mu.Lock()
+		if s.maxMessageSize > 0 {
+			maxMessageSize = s.maxMessageSize
+		}
+		s.mu.Unlock()
+	}
+	session.links[handle] = link
+
+	err := writeFrame(nc, 0, session.channel, described{performAttach, []any{
+		perf.field(0), handle, !role, perf.field(3), perf.field(4),
+		described{sourceType, []any{source}}, described{targetType, []any{target}},
+		nil, false, initialDeliveryCount, maxMessageSize,
+	}}, nil)
+	if err != nil || role {
+		return err
+	}
+
+	deliveryCount, _ := perf.field(9).(uint32)
+	return writeFrame(nc, 0, session.channel, described{performFlow, []any{
+		session.nextIncoming, uint32(5000), session.nextOutgoing, uint32(5000), handle, deliveryCount, uint32(100),
+	}}, nil)
+}
+
+// flow updates the credit of a link the stand-in sends on
+func (s *hubStandIn) flow(nc net.Conn, session *standInSession, perf described) error {
+	handle, ok := perf.field(4).(uint32)
+	link := session.links[handle]
+	if !ok || link == nil || link.receiving {
+		return nil
+	}
+	deliveryCount, ok := perf.field(5).(uint32)
+	if !ok {
+		deliveryCount = link.deliveryCount
+	}
+	credit, _ := perf.field(6).(uint32)
+	link.credit = deliveryCount + credit - link.deliveryCount
+	return s.flush(nc, session, link)
+}
+
+// flush sends the pending replies of a link, as credit allows
+func (s *hubStandIn) flush(nc net.Conn, session *standInSession, link *standInLink) error {
+	for link.credit > 0 && len(link.pending) > 0 {
+		data, err := link.pending[0].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		tag := binary.BigEndian.AppendUint32(nil, session.nextOutgoing)
+		err = writeFrame(nc, 0, session.channel, described{performTransfer, []any{
+			link.handle, session.nextOutgoing, tag, uint32(0), true,
+		}}, data)
+		if err != nil {
+			return err
+		}
+		link.pending = link.pending[1:]
+		link.credit--
+		link.deliveryCount++
+		session.nextOutgoing++
+	}
+	return nil
+}
+
+// transfer receives a message, answering claims and management requests
+//
+// returns true when the connection is to be dropped.
+func (s *hubStandIn) transfer(nc net.Conn, session *standInSession, perf described, payload []byte) (bool, error) {
+	session.nextIncoming++
+	link := session.links[perf.field(0).(uint32)]
+	if link.data == nil {
+		link.deliveryID, _ = perf.field(1).(uint32)
+		link.format, _ = perf.field(3).(uint32)
+		link.settled, _ = perf.field(4).(bool)
+		link.data = []byte{}
+	}
+	link.data = append(link.data, payload...)
+	if more, _ := perf.field(5).(bool); more {
+		return false, nil
+	}
+	data := link.data
+	link.data = nil
+
+	msg := new(amqp.Message)
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return false, err
+	}
+
+	var (
+		state any = described{stateAccepted, []any{}}
+		reply *amqp.Message
+	)
+	s.mu.Lock()
+	switch link.address {
+	case cbsAddress:
+		s.claims = append(s.claims, msg)
+		reply = response(msg, s.claimStatus, nil)
+	case managementAddress:
+		s.requests = append(s.requests, msg)
+		reply = response(msg, 200, map[string]any{
+			"name":            testHub,
+			"created_at":      time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			"partition_count": int32(2),
+			"partition_ids":   []string{"0", "1"},
+		})
+	default:
+		if s.drops > 0 {
+			s.drops--
+			s.mu.Unlock()
+			return true, nil
+		}
+		s.transfers = append(s.transfers, hubTransfer{format: link.format, size: len(data), msg: msg})
+		if s.reject != "" {
+			state = described{stateRejected, []any{described{amqpErrorType, []any{symbol(s.reject), "rejected by the stand-in"}}}}
+		}
+	}
+	s.mu.Unlock()
+
+	if !link.settled {
+		err := writeFrame(nc, 0, session.channel, described{performDisposition, []any{true, link.deliveryID, nil, true, state}}, nil)
+		if err != nil {
+			return false, err
+		}
+	}
+	if reply == nil {
+		return false, nil
+	}
+
+	// Replies are sent on the link whose target is the reply address of the request
+	for _, l := range session.links {
+		if !l.receiving && l.address == link.address && msg.Properties != nil && msg.Properties.ReplyTo != nil && l.replyTo == *msg.Properties.ReplyTo {
+			l.pending = append(l.pending, reply)
+			return false, s.flush(nc, session, l)
+		}
+	}
+	return false, errors.New("no reply link")
+}
+
+// response returns the response of a request with a status code
+func response(request *amqp.Message, status int32, value any) *amqp.Message {
+	return &amqp.Message{
+		Properties: &amqp.MessageProperties{CorrelationID: request.Properties.MessageID},
+		ApplicationProperties: map[string]any{
+			"status-code":        status,
+			"status-description": "",
+		},
+		Value: value,
+	}
+}
+
+// tokenAudience returns the audience a SAS token is signed for
+func tokenAudience(t *testing.T, token any) string {
+	t.Helper()
+	s, _ := token.(string)
+	values, err := url.ParseQuery(strings.TrimPrefix(s, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values.Get("sr")
+}
+
+func newTestAMQPHub(t *testing.T, s *hubStandIn) *amqpHub {
+	t.Helper()
+	provider, err := sas.NewTokenProvider(sas.TokenProviderWithKey("RootManageSharedAccessKey", "fluffypuppy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := s.transport()
+	h, err := newAMQPHub(testNamespace, testHub, provider, &transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close(context.Background()) })
+	return h
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestAMQPHubSend(t *testing.T) {
+	s := newHubStandIn(t)
+	h := newTestAMQPHub(t, s)
+
+	key := "a:9100"
+	event := eventhub.NewEvent([]byte(`{"value":1}`))
+	event.ID = "event-1"
+	event.PartitionKey = &key
+	event.Properties = map[string]interface{}{"Table": "up"}
+	event.RawAMQPMessage.Properties.ContentType = "application/json"
+	if err := h.Send(testContext(t), event); err != nil {
+		t.Fatal(err)
+	}
+
+	transfers := s.received()
+	if len(transfers) != 1 {
+		t.Fatalf("received %d messages, want 1", len(transfers))
+	}
+	msg := transfers[0].msg
+	if transfers[0].format != 0 {
+		t.Errorf("message format = 0x%x, want 0", transfers[0].format)
+	}
+	if string(msg.GetData()) != `{"value":1}` {
+		t.Errorf("data = %q", msg.GetData())
+	}
+	if msg.Properties.MessageID != "event-1" {
+		t.Errorf("message-id = %v, want event-1", msg.Properties.MessageID)
+	}
+	if msg.Properties.ContentType == nil || *msg.Properties.ContentType != "application/json" {
+		t.Errorf("content-type = %v, want application/json", msg.Properties.ContentType)
+	}
+	if msg.ApplicationProperties["Table"] != "up" {
+		t.Errorf("application properties = %v", msg.ApplicationProperties)
+	}
+	if msg.Annotations[partitionKeyAnnotation] != key {
+		t.Errorf("annotations = %v, want the partition key", msg.Annotations)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.claims) != 1 {
+		t.Fatalf("claims = %d, want 1", len(s.claims))
+	}
+	if audience := s.claims[0].ApplicationProperties["name"]; audience != testAudience {
+		t.Errorf("claim audience = %v, want %s", audience, testAudience)
+	}
+	if audience := tokenAudience(t, s.claims[0].Value); audience != testAudience {
+		t.Errorf("claim token audience = %s, want %s", audience, testAudience)
+	}
+}
+
+func TestAMQPHubSendBatch(t *testing.T) {
+	s := newHubStandIn(t)
+	s.maxMessageSize = 600
+	h := newTestAMQPHub(t, s)
+
+	keys := []string{"a", "a", "b", "a", "", "a", "a"}
+	var events []*eventhub.Event
+	for i, key := range keys {
+		event := eventhub.NewEvent(bytes.Repeat([]byte{'0' + byte(i)}, 100))
+		if key != "" {
+			event.PartitionKey = &keys[i]
+		}
+		events = append(events, event)
+	}
+	if err := h.SendBatch(testContext(t), events); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are batched per partition key, in order, within the message size
+	received := make(map[string][]byte)
+	batches := make(map[string]int)
+	for _, transfer := range s.received() {
+		if transfer.format != batchMessageFormat {
+			t.Errorf("message format = 0x%x, want 0x%x", transfer.format, batchMessageFormat)
+		}
+		if transfer.size > 600 {
+			t.Errorf("batch of %d bytes exceeds the max message size", transfer.size)
+		}
+		key, _ := transfer.msg.Annotations[partitionKeyAnnotation].(string)
+		batches[key]++
+		for _, data := range transfer.msg.Data {
+			event := new(amqp.Message)
+			if err := event.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if event.Annotations[partitionKeyAnnotation] != transfer.msg.Annotations[partitionKeyAnnotation] {
+				t.Errorf("event partition key %v in batch of %v", event.Annotations[partitionKeyAnnotation], key)
+			}
+			received[key] = append(received[key], event.GetData()[0])
+		}
+	}
+
+	want := map[string]string{"a": "01356", "b": "2", "": "4"}
+	for key, events := range want {
+		if string(received[key]) != events {
+			t.Errorf("events of key %q = %s, want %s", key, received[key], events)
+		}
+	}
+	if batches["a"] < 2 || batches["b"] != 1 || batches[""] != 1 {
+		t.Errorf("batches = %v, want key a split", batches)
+	}
+}
+
+func TestAMQPHubRuntimeInformation(t *testing.T) {
+	s := newHubStandIn(t)
+	h := newTestAMQPHub(t, s)
+
+	info, err := h.GetRuntimeInformation(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != testHub || info.PartitionCount != 2 || len(info.PartitionIDs) != 2 || info.CreatedAt.IsZero() {
+		t.Errorf("runtime information = %+v", info)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) != 1 {
+		t.Fatalf("management requests = %d, want 1", len(s.requests))
+	}
+	properties := s.requests[0].ApplicationProperties
+	if properties["operation"] != "READ" || properties["type"] != eventhub.MsftVendor+":eventhub" || properties["name"] != testHub {
+		t.Errorf("management request = %v", properties)
+	}
+	// The management token is signed for the audience of the claim
+	if audience := tokenAudience(t, properties["security_token"]); audience != testAudience {
+		t.Errorf("management token audience = %s, want %s", audience, testAudience)
+	}
+}
+
+func TestAMQPHubReconnect(t *testing.T) {
+	s := newHubStandIn(t)
+	s.drops = 1
+	h := newTestAMQPHub(t, s)
+
+	if err := h.Send(testContext(t), eventhub.NewEventFromString("retried")); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("connections = %d, want a reconnect", n)
+	}
+	if transfers := s.received(); len(transfers) != 1 || string(transfers[0].msg.GetData()) != "retried" {
+		t.Errorf("received %d messages, want the retried event", len(transfers))
+	}
+}
+
+func TestAMQPHubErrors(t *testing.T) {
+	t.Run("claim", func(t *testing.T) {
+		s := newHubStandIn(t)
+		s.claimStatus = 401
+		h := newTestAMQPHub(t, s)
+
+		err := h.Send(testContext(t), eventhub.NewEventFromString("denied"))
+		if err == nil || !strings.HasPrefix(err.Error(), "negotiate claim: ") {
+			t.Errorf("error = %v, want a claim error", err)
+		}
+		if len(s.received()) != 0 {
+			t.Error("event sent without a claim")
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		s := newHubStandIn(t)
+		s.reject = "amqp:resource-limit-exceeded"
+		h := newTestAMQPHub(t, s)
+
+		err := h.Send(testContext(t), eventhub.NewEventFromString("rejected"))
+		var amqpErr *amqp.Error
+		if !errors.As(err, &amqpErr) || amqpErr.Condition != amqp.ErrCondResourceLimitExceeded {
+			t.Errorf("error = %v, want the rejection", err)
+		}
+		// Rejections are not retried on a new connection
+		if n := s.connections(); n != 1 {
+			t.Errorf("connections = %d, want 1", n)
+		}
+	})
+}
+
+func TestNewHubFromConfig(t *testing.T) {
+	emulator := "Endpoint=sb://localhost;SharedAccessKeyName=RootManageSharedAccessKey;SharedAccessKey=SAS_KEY_VALUE;UseDevelopmentEmulator=true;"
+
+	tests := []struct {
+		name    string
+		cfg     EventHubConfig
+		library bool
+	}{
+		{name: "connection string", cfg: EventHubConfig{ConnString: testConnStr}, library: true},
+		{name: "websockets", cfg: EventHubConfig{ConnString: testConnStr, Transport: TransportConfig{WebSockets: true}}, library: true},
+		{name: "namespace websockets", cfg: EventHubConfig{Namespace: "test", Hub: testHub, KeyName: "RootManageSharedAccessKey", KeyValue: "fluffypuppy", Transport: TransportConfig{WebSockets: true}}, library: true},
+		{name: "proxy", cfg: EventHubConfig{ConnString: testConnStr, Transport: TransportConfig{WebSockets: true, ProxyURL: "http://proxy:3128"}}},
+		{name: "endpoint", cfg: EventHubConfig{ConnString: testConnStr, Transport: TransportConfig{Endpoint: "localhost:5671"}}},
+		{name: "cloudevents", cfg: EventHubConfig{ConnString: testConnStr, CloudEvents: cloudevents.Config{Mode: cloudevents.BinaryMode}}},
+		{name: "emulator", cfg: EventHubConfig{ConnString: emulator, Hub: "eh1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hb, err := newHubFromConfig(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hb.Close(context.Background())
+
+			switch h := hb.(type) {
+			case *libraryHub:
+				if !tt.library {
+					t.Error("hub connected by the eventhub library")
+				}
+			case *amqpHub:
+				if tt.library {
+					t.Error("hub connected by the adapter")
+				}
+				if tt.name == "emulator" && (h.dialer.tls != nil || h.name != "eh1") {
+					t.Errorf("emulator hub %s with TLS %v, want eh1 without TLS", h.name, h.dialer.tls != nil)
+				}
+			}
+		})
+	}
+}
+
+func TestClientWrite(t *testing.T) {
+	s := newHubStandIn(t)
+	client, err := NewClient(&EventHubConfig{
+		ConnString:   testConnStr,
+		PartKeyLabel: "instance",
+		Serializer:   serializers.SerializerConfig{DataFormat: "json", Fields: record.DefaultFields()},
+		CloudEvents:  cloudevents.Config{Mode: cloudevents.BinaryMode, Source: "/adapter"},
+		Transport:    s.transport(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(context.Background())
+	if client.Name() != testHub {
+		t.Errorf("name = %s, want %s", client.Name(), testHub)
+	}
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "a:9100"}, Value: 1, Timestamp: 1700000000000},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "b:9100"}, Value: 0, Timestamp: 1700000000000},
+	}
+	result, err := client.Write(testContext(t), samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != len(samples) {
+		t.Errorf("result = %+v, want %d sent", result, len(samples))
+	}
+
+	transfers := s.received()
+	if len(transfers) != len(samples) {
+		t.Fatalf("received %d messages, want %d", len(transfers), len(samples))
+	}
+	for _, transfer := range transfers {
+		msg := transfer.msg
+		// In binary mode the content type is the content-type message property
+		if msg.Properties.ContentType == nil || *msg.Properties.ContentType != "application/json" {
+			t.Errorf("content-type = %v, want application/json", msg.Properties.ContentType)
+		}
+		if _, ok := msg.ApplicationProperties[ContentTypeProperty]; ok {
+			t.Errorf("application properties = %v, want no %s", msg.ApplicationProperties, ContentTypeProperty)
+		}
+		if msg.ApplicationProperties[cloudevents.PropertyPrefix+"source"] != "/adapter" {
+			t.Errorf("application properties = %v, want the CloudEvents attributes", msg.ApplicationProperties)
+		}
+		if msg.Annotations[partitionKeyAnnotation] == nil {
+			t.Errorf("annotations = %v, want the partition key", msg.Annotations)
+		}
+	}
+}
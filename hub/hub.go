@@ -18,19 +18,41 @@ package hub
 
 import (
 	"context"
+	"crypto/rsa"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/v4/aad"
+	"github.com/Azure/azure-amqp-common-go/v4/auth"
 	"github.com/Azure/azure-amqp-common-go/v4/sas"
 	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/prometheus/common/model"
+	"golang.org/x/crypto/pkcs12"
 
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/payload"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/registry"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
 )
 
+const (
+	// ContentTypeProperty is the event property holding the MIME type of the event data.
+	ContentTypeProperty = payload.ContentTypeProperty
+	// eventHubsResource is the Azure Active Directory resource of Event Hubs tokens.
+	eventHubsResource = "https://eventhubs.azure.net/"
+)
+
 // EventHubConfig for an Event Hub
 type EventHubConfig struct {
 	Namespace    string
@@ -45,18 +67,39 @@ type EventHubConfig struct {
 	CertPassword string
 	PartKeyLabel string
 	Batch        bool
+	Concurrency  int
 	ADXMapping   string
+	ADXTable     string
+	ADXFallback  string
+	Properties   map[string]string
 	Serializer   serializers.SerializerConfig
+	Registry     registry.Config
+	CloudEvents  cloudevents.Config
+	Compression  string
+	Transport    TransportConfig
+}
+
+// RoutingConfig returns the single event routing configuration
+func (cfg *EventHubConfig) RoutingConfig() *routing.Config {
+	return &routing.Config{
+		Table:         cfg.ADXTable,
+		FallbackTable: cfg.ADXFallback,
+		Mapping:       cfg.ADXMapping,
+		Properties:    cfg.Properties,
+	}
 }
 
 // EventHubClient sends Prometheus samples to Event Hubs
 type EventHubClient struct {
-	hub          *eventhub.Hub
+	// mu guards the hub, replaced by ResetConfig, and the runtime information
+	mu           sync.RWMutex
+	hub          *activeHub
 	runtimeInfo  *eventhub.HubRuntimeInformation
 	batch        bool
+	concurrency  int
 	partKeyLabel string
-	adxMapping   string
-	serializer   serializers.Serializer
+	router       *routing.Router
+	encoder      *payload.Encoder
 }
 
 // NewClient creates a new event hub client
@@ -73,122 +116,197 @@ func NewClient(cfg *EventHubConfig) (*EventHubClient, error) {
 		return nil, err
 	}
 
-	ser, err := serializers.NewSerializer(&cfg.Serializer)
+	encoder, err := payload.New(&payload.Config{
+		Serializer:  cfg.Serializer,
+		Registry:    cfg.Registry,
+		CloudEvents: cfg.CloudEvents,
+		Compression: cfg.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := routing.New(cfg.RoutingConfig())
 	if err != nil {
 		return nil, err
 	}
 
 	client := &EventHubClient{
-		hub:          hb,
+		hub:          &activeHub{hubSender: hb},
 		runtimeInfo:  rt,
-		adxMapping:   cfg.ADXMapping,
+		router:       router,
 		batch:        cfg.Batch,
+		concurrency:  cfg.Concurrency,
 		partKeyLabel: cfg.PartKeyLabel,
-		serializer:   ser,
+		encoder:      encoder,
 	}
 
 	return client, nil
 }
 
+// activeHub tracks the sends in progress on a hub.
+type activeHub struct {
+	hubSender
+	sends sync.WaitGroup
+}
+
+// acquire returns the current hub, which is not closed until released with sends.Done()
+func (c *EventHubClient) acquire() *activeHub {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.hub.sends.Add(1)
+	return c.hub
+}
+
+// ResetConfig replaces the hub with a new connection, resolving the Event Hub address again
+//
+// The previous hub is closed once its sends in progress finish. Hubs
+// connected by the adapter reconnect after connection failures themselves
+// and are not replaced.
 func (c *EventHubClient) ResetConfig(cfg *EventHubConfig) error {
+	c.mu.RLock()
+	_, reconnects := c.hub.hubSender.(*amqpHub)
+	c.mu.RUnlock()
+	if reconnects {
+		return nil
+	}
+
 	log.Info().Msg("Resetting EventHub Configuration")
-	hub, err := newHubFromConfig(cfg)
+	hb, err := newHubFromConfig(cfg)
 	if err != nil {
 		log.ErrorObj(err).Msg("Failed to reset configuration")
 		return err
 	}
 
-	c.hub = hub
+	c.mu.Lock()
+	previous := c.hub
+	c.hub = &activeHub{hubSender: hb}
+	c.mu.Unlock()
+
+	go func() {
+		previous.sends.Wait()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		if err := previous.Close(ctx); err != nil {
+			log.ErrorObj(err).Msg("Failed to close previous event hub connection")
+		}
+	}()
 	return nil
 }
 
 // Write creates and sends events from metric samples
-func (c *EventHubClient) Write(ctx context.Context, samples model.Samples) error {
+//
+// returns the outcome of each sample and, when events were not delivered, an error.
+func (c *EventHubClient) Write(ctx context.Context, samples model.Samples) (remote.Result, error) {
+	var result remote.Result
+
 	// Stop processing if empty
 	if len(samples) == 0 {
-		return nil
+		return result, nil
 	}
 
 	begin := time.Now()
 
+	events := make([]*eventhub.Event, 0, len(samples))
+	for _, sample := range samples {
+		event, size, err := c.newEvent(sample)
+		if errors.Is(err, serializers.ErrDropped) {
+			result.Dropped++
+			continue
+		}
+		if err != nil {
+			log.ErrorObj(err).Msg("Could not serialize sample")
+			result.SerializeFailed++
+			continue
+		}
+
+		result.Bytes += size
+		result.CompressedBytes += len(event.Data)
+		events = append(events, event)
+	}
+
 	if c.batch {
 		// Batch Events
-		events := make([]*eventhub.Event, 0)
-		for _, sample := range samples {
-			serializedEvent, err := c.serializer.Serialize(*sample)
+		if len(events) > 0 {
+			hb := c.acquire()
+			err := hb.SendBatch(ctx, events)
+			hb.sends.Done()
 			if err != nil {
-				log.ErrorObj(err).Msg("Could not serialize sample")
-				continue
+				log.ErrorObj(err).Msg("send event batch")
+				result.SendFailed += len(events)
+				return result, err
 			}
-			event := eventhub.NewEvent(serializedEvent)
-
-			if c.partKeyLabel != "" {
-				log.Debug().Msg("using partition key label: " + c.partKeyLabel)
-				partKeyLabelName := model.LabelName(c.partKeyLabel)
-				if partKey, ok := sample.Metric[partKeyLabelName]; ok {
-					partKeyStr := (string)(partKey)
-					event.PartitionKey = &partKeyStr
-					log.Debug().Msg("Partition key: " + partKeyStr)
-				} else {
-					log.Debug().Msg("partition key label not found: " + c.partKeyLabel)
-				}
-			}
-
-			events = append(events, event)
-		}
-
-		if err := c.hub.SendBatch(ctx, eventhub.NewEventBatchIterator(events...)); err != nil {
-			log.ErrorObj(err).Msg("send event batch")
-			return err
+			result.Sent += len(events)
 		}
 
 		duration := time.Since(begin).Seconds()
-		log.Debug().Int("count", len(samples)).Float64("duration_sec", duration).Msg("Wrote samples as batch events")
+		log.Debug().Int("count", len(samples)).Int("sent", result.Sent).Int("serialize_failed", result.SerializeFailed).Float64("duration_sec", duration).Msg("Wrote samples as batch events")
 	} else {
 		// Single Event
-		for _, sample := range samples {
-			serializedEvent, err := c.serializer.Serialize(*sample)
-			if err != nil {
-				log.ErrorObj(err).Msg("Could not serialize sample")
-				continue
-			}
+		err := c.sendEvents(ctx, events, &result)
 
-			metricName := sample.Metric[model.MetricNameLabel]
-
-			event := eventhub.NewEvent(serializedEvent)
-			event.Properties = map[string]interface{}{
-				"Table":                     string(metricName),
-				"Format":                    c.serializer.ADXFormat().String(),
-				"IngestionMappingReference": c.adxMapping,
-			}
-			if c.partKeyLabel != "" {
-				log.Debug().Msg("using partition key label: " + c.partKeyLabel)
-				partKeyLabelName := model.LabelName(c.partKeyLabel)
-				if partKey, ok := sample.Metric[partKeyLabelName]; ok {
-					partKeyStr := (string)(partKey)
-					event.PartitionKey = &partKeyStr
-					log.Debug().Msg("Partition key: " + partKeyStr)
-				} else {
-					log.Debug().Msg("partition key label not found: " + c.partKeyLabel)
-				}
-			}
+		duration := time.Since(begin).Seconds()
+		log.Debug().Int("count", len(samples)).Int("sent", result.Sent).Int("serialize_failed", result.SerializeFailed).Int("send_failed", result.SendFailed).Int("dropped", result.Dropped).Float64("duration_sec", duration).Msg("Wrote samples as single events")
 
-			if err := c.hub.Send(ctx, event); err != nil {
-				log.ErrorObj(err).Msg("send event")
-				continue
-			}
+		if err != nil {
+			return result, err
 		}
+	}
 
-		duration := time.Since(begin).Seconds()
-		log.Debug().Int("count", len(samples)).Float64("duration_sec", duration).Msg("Wrote samples as single events")
+	return result, nil
+}
+
+// newEvent serializes a sample into an event
+//
+// returns the event and the size of its data before compression.
+func (c *EventHubClient) newEvent(sample *model.Sample) (*eventhub.Event, int, error) {
+	properties := c.eventProperties(sample)
+	serializedEvent, size, err := c.encoder.Encode(sample, properties)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return nil
+	var contentType string
+	if c.encoder.Enveloped() {
+		// The AMQP binding maps the content type to the content-type message property
+		contentType, _ = properties[ContentTypeProperty].(string)
+		delete(properties, ContentTypeProperty)
+	}
+
+	event := eventhub.NewEvent(serializedEvent)
+	event.Properties = properties
+	// Only sent by amqpHub, the eventhub library sends no message properties
+	event.RawAMQPMessage.Properties.ContentType = contentType
+
+	if c.partKeyLabel != "" {
+		log.Debug().Msg("using partition key label: " + c.partKeyLabel)
+		if partKey, ok := routing.PartitionKey(sample.Metric, c.partKeyLabel); ok {
+			event.PartitionKey = &partKey
+			log.Debug().Msg("Partition key: " + partKey)
+		} else {
+			log.Debug().Msg("partition key label not found: " + c.partKeyLabel)
+		}
+	}
+
+	return event, size, nil
+}
+
+// eventProperties returns the routing properties of the event for a sample
+//
+// Data compressed with a codec Azure Data Explorer can't decompress is not routed.
+func (c *EventHubClient) eventProperties(sample *model.Sample) map[string]interface{} {
+	if c.batch {
+		return make(map[string]interface{}, c.encoder.Properties())
+	}
+	return c.router.Properties(sample.Metric, c.encoder.ADXFormat())
 }
 
 // Close shuts down an any active connections
 func (c *EventHubClient) Close(ctx context.Context) error {
-	if err := c.hub.Close(ctx); err != nil {
+	c.mu.RLock()
+	hb := c.hub
+	c.mu.RUnlock()
+	if err := hb.Close(ctx); err != nil {
 		return err
 	}
 	return nil
@@ -196,47 +314,250 @@ func (c *EventHubClient) Close(ctx context.Context) error {
 
 // Name identifies the client path
 func (c *EventHubClient) Name() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.runtimeInfo.Path
 }
 
+// RuntimeInfo returns the runtime information of the Event Hub, as of the last connection check
+func (c *EventHubClient) RuntimeInfo() eventhub.HubRuntimeInformation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return *c.runtimeInfo
+}
+
+// Ping checks the connection to the Event Hub by requesting its runtime information
+func (c *EventHubClient) Ping(ctx context.Context) error {
+	hb := c.acquire()
+	rt, err := hb.GetRuntimeInformation(ctx)
+	hb.sends.Done()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.runtimeInfo = rt
+	c.mu.Unlock()
+	return nil
+}
+
 // newHubFromConfig returns an event hub instance creation function based on the configuration options provided
 //
 // Based on (github.com/Azure/azure-event-hubs-go/v2) NewHubWithNamespaceNameAndEnvironment(),
 // but uses a local config instead of environment variables
-func newHubFromConfig(cfg *EventHubConfig) (*eventhub.Hub, error) {
+func newHubFromConfig(cfg *EventHubConfig) (hubSender, error) {
+	// CloudEvents need the content-type message property, which the eventhub library does not send
+	if cfg.Transport.custom() || isEmulator(cfg.ConnString) || cfg.CloudEvents.Enabled() {
+		return newAMQPHubFromConfig(cfg)
+	}
+
+	var opts []eventhub.HubOption
+	if cfg.Transport.WebSockets {
+		opts = append(opts, eventhub.HubWithWebSocketConnection())
+	}
+
 	if cfg.ConnString != "" {
-		return eventhub.NewHubFromConnectionString(cfg.ConnString)
+		hb, err := eventhub.NewHubFromConnectionString(cfg.ConnString, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &libraryHub{hub: hb}, nil
 	}
 
 	if cfg.Namespace != "" && cfg.Hub != "" {
-		if cfg.KeyName != "" && cfg.KeyValue != "" {
-			provider, sasErr := sas.NewTokenProvider(sas.TokenProviderWithKey(cfg.KeyName, cfg.KeyValue))
-			if sasErr == nil {
-				return eventhub.NewHub(cfg.Namespace, cfg.Hub, provider)
+		provider, err := tokenProviderFromConfig(cfg)
+		if err == nil {
+			hb, err := eventhub.NewHub(cfg.Namespace, cfg.Hub, provider, opts...)
+			if err != nil {
+				return nil, err
 			}
-			log.ErrorObj(sasErr).Msg("failure creating SAS token provider")
+			return &libraryHub{hub: hb}, nil
+		}
+	}
+
+	return nil, errors.New("unable to determine event hub creation; missing configuration parameter")
+}
+
+// newAMQPHubFromConfig returns an event hub connected by the adapter's own transport
+func newAMQPHubFromConfig(cfg *EventHubConfig) (hubSender, error) {
+	if cfg.ConnString != "" {
+		parsed, err := parseConnString(cfg.ConnString)
+		if err != nil {
+			return nil, err
+		}
+		provider, err := sas.NewTokenProvider(sas.TokenProviderWithKey(parsed.keyName, parsed.key))
+		if err != nil {
+			return nil, err
 		}
 
-		if cfg.TenantID != "" && cfg.ClientID != "" {
-			if cfg.ClientSecret != "" {
-				provider, aadErr := aad.NewJWTProvider(jwtProviderFromConfig(*cfg))
-				if aadErr == nil {
-					return eventhub.NewHub(cfg.Namespace, cfg.Hub, provider)
-				}
-				log.ErrorObj(aadErr).Msg("failure creating AAD token provider with client secret")
+		name := parsed.hub
+		if name == "" {
+			name = cfg.Hub
+		}
+		if name == "" {
+			return nil, errors.New("event hub name missing from the connection string EntityPath and the configuration")
+		}
+		transport := cfg.Transport
+		if parsed.emulator {
+			// The emulator only listens for AMQP without TLS
+			transport.DisableTLS = true
+		}
+		return newAMQPHub(parsed.host, name, provider, &transport)
+	}
+
+	if cfg.Namespace != "" && cfg.Hub != "" {
+		provider, err := tokenProviderFromConfig(cfg)
+		if err == nil {
+			return newAMQPHub(cfg.Namespace+"."+azure.PublicCloud.ServiceBusEndpointSuffix, cfg.Hub, provider, &cfg.Transport)
+		}
+	}
+
+	return nil, errors.New("unable to determine event hub creation; missing configuration parameter")
+}
+
+// connString is a parsed Event Hubs connection string
+type connString struct {
+	host     string
+	hub      string
+	keyName  string
+	key      string
+	emulator bool
+}
+
+// parseConnString parses a connection string, including those of the Event Hubs emulator
+//
+// Unlike (github.com/Azure/azure-amqp-common-go/v4/conn) ParsedConnectionFromStr(),
+// accepts single label hosts, ex. "sb://localhost", and a trailing separator.
+func parseConnString(s string) (*connString, error) {
+	cs := &connString{}
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, errors.New("failed parsing connection string due to unmatched key value separated by '='")
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "endpoint":
+			u, err := url.Parse(value)
+			if err != nil {
+				return nil, errors.New("failed parsing connection string due to an incorrectly formatted Endpoint value")
 			}
+			cs.host = u.Hostname()
+		case "sharedaccesskeyname":
+			cs.keyName = value
+		case "sharedaccesskey":
+			cs.key = value
+		case "entitypath":
+			cs.hub = value
+		case "usedevelopmentemulator":
+			cs.emulator = strings.EqualFold(value, "true")
+		}
+	}
+
+	switch {
+	case cs.host == "":
+		return nil, errors.New("connection string Endpoint must not be empty")
+	case cs.keyName == "" || cs.key == "":
+		return nil, errors.New("connection string SharedAccessKeyName and SharedAccessKey must not be empty")
+	}
+	return cs, nil
+}
+
+// isEmulator returns true for a connection string of the Event Hubs emulator
+func isEmulator(connStr string) bool {
+	parsed, err := parseConnString(connStr)
+	return err == nil && parsed.emulator
+}
 
-			if cfg.CertPath != "" && cfg.CertPassword != "" {
-				provider, aadErr := aad.NewJWTProvider(jwtProviderFromConfig(*cfg))
-				if aadErr == nil {
-					return eventhub.NewHub(cfg.Namespace, cfg.Hub, provider)
-				}
-				log.ErrorObj(aadErr).Msg("failure creating AAD token provider with certificate")
+// tokenProviderFromConfig returns the first token provider the configured credentials create
+func tokenProviderFromConfig(cfg *EventHubConfig) (auth.TokenProvider, error) {
+	if cfg.KeyName != "" && cfg.KeyValue != "" {
+		provider, sasErr := sas.NewTokenProvider(sas.TokenProviderWithKey(cfg.KeyName, cfg.KeyValue))
+		if sasErr == nil {
+			return provider, nil
+		}
+		log.ErrorObj(sasErr).Msg("failure creating SAS token provider")
+	}
+
+	if cfg.TenantID != "" && cfg.ClientID != "" {
+		if cfg.ClientSecret != "" {
+			provider, aadErr := newJWTProvider(cfg)
+			if aadErr == nil {
+				return provider, nil
 			}
+			log.ErrorObj(aadErr).Msg("failure creating AAD token provider with client secret")
+		}
+
+		if cfg.CertPath != "" && cfg.CertPassword != "" {
+			provider, aadErr := newJWTProvider(cfg)
+			if aadErr == nil {
+				return provider, nil
+			}
+			log.ErrorObj(aadErr).Msg("failure creating AAD token provider with certificate")
 		}
 	}
 
-	return nil, errors.New("unable to determine event hub creation; missing configuration parameter")
+	return nil, errors.New("no usable event hub credentials")
+}
+
+// newJWTProvider creates an AAD token provider, requesting tokens through the configured proxy
+func newJWTProvider(cfg *EventHubConfig) (*aad.TokenProvider, error) {
+	if cfg.Transport.ProxyURL == "" {
+		return aad.NewJWTProvider(jwtProviderFromConfig(*cfg))
+	}
+
+	client, err := cfg.Transport.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	spt, err := servicePrincipalToken(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	return aad.NewJWTProvider(jwtProviderFromConfig(*cfg), aad.JWTProviderWithAADToken(spt))
+}
+
+// servicePrincipalToken requests an Event Hubs token with the client secret or certificate using a HTTP client
+//
+// Based on (github.com/Azure/azure-amqp-common-go/v4/aad) NewServicePrincipalToken(),
+// which always uses the default client
+func servicePrincipalToken(cfg *EventHubConfig, client *http.Client) (*adal.ServicePrincipalToken, error) {
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, cfg.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var spt *adal.ServicePrincipalToken
+	if cfg.ClientSecret != "" {
+		spt, err = adal.NewServicePrincipalToken(*oauthConfig, cfg.ClientID, cfg.ClientSecret, eventHubsResource)
+	} else {
+		var data []byte
+		data, err = os.ReadFile(cfg.CertPath)
+		if err != nil {
+			return nil, err
+		}
+		key, certificate, decodeErr := pkcs12.Decode(data, cfg.CertPassword)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("certificate private key is not a RSA key")
+		}
+		spt, err = adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, cfg.ClientID, certificate, rsaKey, eventHubsResource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	spt.SetSender(client)
+	if err := spt.Refresh(); err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	return spt, nil
 }
 
 // jwtProviderFromConfig provides an aad.JWTProviderOption using provided configuration
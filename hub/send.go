@@ -0,0 +1,120 @@
+package hub
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+const (
+	// DefaultConcurrency is the number of single events sent in parallel when none is configured.
+	DefaultConcurrency = 8
+	// maxJoinedErrors limits the per-event errors kept in an aggregated error.
+	maxJoinedErrors = 5
+)
+
+// sendEvents sends single events using a bounded pool of workers
+//
+// Counts each event in result. Events not attempted before the context is done
+// are not delivered and count as failed sends. returns an error aggregating the
+// failures, or the context error, when any event was not delivered.
+func (c *EventHubClient) sendEvents(ctx context.Context, events []*eventhub.Event, result *remote.Result) error {
+	hb := c.acquire()
+	defer hb.sends.Done()
+
+	workers := c.concurrency
+	if workers < 1 {
+		workers = DefaultConcurrency
+	}
+	if workers > len(events) {
+		workers = len(events)
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sent    int
+		failed  int
+		aborted int
+		errs    []error
+	)
+
+	record := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			sent++
+			return
+		}
+		failed++
+		if len(errs) < maxJoinedErrors {
+			errs = append(errs, err)
+		}
+	}
+
+	queue := make(chan *eventhub.Event)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range queue {
+				err := hb.Send(ctx, event)
+				if err != nil {
+					log.ErrorObj(err).Msg("send event")
+				}
+				record(err)
+			}
+		}()
+	}
+
+	for i, event := range events {
+		// A ready worker must not win over a done context
+		if ctx.Err() == nil {
+			select {
+			case queue <- event:
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		// Context done, remaining events are not attempted
+		aborted = len(events) - i
+		break
+	}
+	close(queue)
+	wg.Wait()
+
+	result.Sent += sent
+	result.SendFailed += failed + aborted
+
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("send %d of %d events failed: %w", failed, len(events), errors.Join(errs...))
+	}
+	if aborted > 0 {
+		err = errors.Join(err, fmt.Errorf("%d of %d events not sent: %w", aborted, len(events), ctx.Err()))
+	}
+	return err
+}
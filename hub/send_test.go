@@ -0,0 +1,77 @@
+package hub
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+// stubSender fails the events of failing
+type stubSender struct {
+	hubSender
+	failing map[string]bool
+}
+
+func (s *stubSender) Send(ctx context.Context, event *eventhub.Event) error {
+	if s.failing[string(event.Data)] {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func TestSendEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		failing    map[string]bool
+		cancelled  bool
+		sent       int
+		sendFailed int
+		want       error
+	}{
+		{name: "sent", sent: 3},
+		{name: "failed", failing: map[string]bool{"1": true}, sent: 2, sendFailed: 1},
+		// Events not attempted are lost, not intentionally dropped
+		{name: "cancelled", cancelled: true, sendFailed: 3, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+			c := &EventHubClient{hub: &activeHub{hubSender: &stubSender{failing: tt.failing}}}
+
+			events := []*eventhub.Event{eventhub.NewEventFromString("0"), eventhub.NewEventFromString("1"), eventhub.NewEventFromString("2")}
+			var result remote.Result
+			err := c.sendEvents(ctx, events, &result)
+
+			if (err != nil) != (tt.sendFailed > 0) || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("error = %v", err)
+			}
+			if result.Sent != tt.sent || result.SendFailed != tt.sendFailed || result.Dropped != 0 {
+				t.Errorf("result = %+v, want %d sent and %d failed", result, tt.sent, tt.sendFailed)
+			}
+		})
+	}
+}
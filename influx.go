@@ -0,0 +1,92 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/influx"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+)
+
+// influxError is the error body of the InfluxDB v2 API.
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// influxHandler receives InfluxDB v2 line protocol write requests and sends them to Event Hubs
+//
+// The "org" and "bucket" parameters and the Authorization header are accepted
+// but not used, every request is written to the configured Event Hub.
+func influxHandler(w writer, settings *handlerSettings) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		limits := settings.limits.Load()
+		httpRequestsTotal.Add(float64(1))
+
+		precision, err := influx.ParsePrecision(c.Query("precision"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, influxError{Code: "invalid", Message: err.Error()})
+			log.ErrorObj(err).Msg("invalid line protocol precision")
+			return
+		}
+
+		// Line protocol bodies are uncompressed unless a Content-Encoding is set
+		reqBuf, err := limits.readBody(c, "identity")
+		if err != nil {
+			abortRequest(c, err)
+			return
+		}
+
+		samples, skipped, err := influx.Parse(reqBuf, precision, time.Now())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, influxError{Code: "invalid", Message: err.Error()})
+			log.ErrorObj(err).Msg("parse line protocol failed")
+			return
+		}
+		if skipped > 0 {
+			log.Debug().Int("skipped", skipped).Msg("line protocol string fields skipped")
+		}
+
+		if err := limits.checkCounts(seriesCount(samples), len(samples)); err != nil {
+			abortRequest(c, err)
+			return
+		}
+		receivedSamples.Add(float64(len(samples)))
+
+		ctx, cancel := context.WithCancel(c)
+		defer cancel()
+		result, err := sendSamples(ctx, w, samples)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, influxError{Code: "unavailable", Message: "sending samples to remote storage failed"})
+			log.ErrorObj(err).Int("num_samples", len(samples)).Int("sent", result.Sent).Int("send_failed", result.SendFailed).Msg("Error sending samples to remote storage")
+			return
+		}
+		if result.SerializeFailed > 0 {
+			// Retrying will not help, report the loss without a retry
+			c.AbortWithStatusJSON(http.StatusBadRequest, influxError{Code: "invalid", Message: "samples could not be serialized"})
+			log.Warn().Int("num_samples", len(samples)).Int("serialize_failed", result.SerializeFailed).Msg("Samples could not be serialized")
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
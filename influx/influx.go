@@ -0,0 +1,180 @@
+// Package influx converts InfluxDB line protocol into Prometheus samples.
+package influx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"github.com/prometheus/common/model"
+)
+
+// valueField is the field name which maps to the bare measurement name.
+const valueField = "value"
+
+// ParsePrecision converts the "precision" query parameter into a Precision value
+// returns an error if the input string does not match known values.
+func ParsePrecision(precisionStr string) (lineprotocol.Precision, error) {
+	switch strings.ToLower(precisionStr) {
+	case "", "ns", "n":
+		return lineprotocol.Nanosecond, nil
+	case "us", "u":
+		return lineprotocol.Microsecond, nil
+	case "ms":
+		return lineprotocol.Millisecond, nil
+	case "s":
+		return lineprotocol.Second, nil
+	default:
+		return lineprotocol.Nanosecond, fmt.Errorf("Unknown precision: '%s'", strings.ToLower(precisionStr))
+	}
+}
+
+// Parse converts line protocol into Prometheus samples
+//
+// Every numeric field of a line becomes a sample named "<measurement>_<field>",
+// or "<measurement>" for a field named "value", labeled with the line's tags.
+// Boolean fields become 1 or 0. String fields have no Prometheus equivalent
+// and are skipped. Lines without a timestamp use now.
+//
+// returns the samples and the number of skipped fields, or an error for
+// malformed line protocol. A single malformed line fails the whole buffer,
+// matching the InfluxDB v2 write API, so a request is never partly written.
+func Parse(buf []byte, precision lineprotocol.Precision, now time.Time) (model.Samples, int, error) {
+	var samples model.Samples
+	skipped := 0
+
+	dec := lineprotocol.NewDecoderWithBytes(buf)
+	for dec.Next() {
+		measurement, err := dec.Measurement()
+		if err != nil {
+			return nil, 0, err
+		}
+		name := MetricName(string(measurement))
+
+		tags := make(model.Metric)
+		for {
+			key, value, err := dec.NextTag()
+			if err != nil {
+				return nil, 0, err
+			}
+			if key == nil {
+				break
+			}
+			tags[model.LabelName(LabelName(string(key)))] = model.LabelValue(value)
+		}
+
+		type field struct {
+			name  string
+			value float64
+		}
+		var fields []field
+		for {
+			key, value, err := dec.NextField()
+			if err != nil {
+				return nil, 0, err
+			}
+			if key == nil {
+				break
+			}
+
+			v, ok := fieldValue(value)
+			if !ok {
+				skipped++
+				continue
+			}
+
+			fieldName := name
+			if string(key) != valueField {
+				fieldName = name + "_" + MetricName(string(key))
+			}
+			fields = append(fields, field{name: fieldName, value: v})
+		}
+
+		// The timestamp follows the fields
+		ts, err := dec.Time(precision, now)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, f := range fields {
+			metric := make(model.Metric, len(tags)+1)
+			for label, value := range tags {
+				metric[label] = value
+			}
+			metric[model.MetricNameLabel] = model.LabelValue(f.name)
+
+			samples = append(samples, &model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(f.value),
+				Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+			})
+		}
+	}
+	if err := dec.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return samples, skipped, nil
+}
+
+// fieldValue returns the sample value of a field, false for string fields.
+func fieldValue(v lineprotocol.Value) (float64, bool) {
+	switch v.Kind() {
+	case lineprotocol.Float:
+		return v.FloatV(), true
+	case lineprotocol.Int:
+		return float64(v.IntV()), true
+	case lineprotocol.Uint:
+		return float64(v.UintV()), true
+	case lineprotocol.Bool:
+		if v.BoolV() {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// MetricName replaces characters which are invalid in a Prometheus metric name
+func MetricName(name string) string {
+	return sanitize(name, func(r rune) bool { return r == '_' || r == ':' })
+}
+
+// LabelName replaces characters which are invalid in a Prometheus label name
+func LabelName(name string) string {
+	return sanitize(name, func(r rune) bool { return r == '_' })
+}
+
+// sanitize replaces runes which are not ASCII letters, digits or allowed with
+// underscores, and prefixes names starting with a digit.
+func sanitize(name string, allowed func(rune) bool) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || allowed(r) {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
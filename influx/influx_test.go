@@ -0,0 +1,162 @@
+package influx
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"github.com/prometheus/common/model"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	at := func(sec int64) model.Time { return model.TimeFromUnix(sec) }
+
+	tests := []struct {
+		name      string
+		line      string
+		precision lineprotocol.Precision
+		want      model.Samples
+		skipped   int
+	}{
+		{
+			name:      "fields",
+			line:      "cpu,host=a usage_idle=90.5,usage_user=9.5 1700000000000000000",
+			precision: lineprotocol.Nanosecond,
+			want: model.Samples{
+				{Metric: model.Metric{"__name__": "cpu_usage_idle", "host": "a"}, Value: 90.5, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "cpu_usage_user", "host": "a"}, Value: 9.5, Timestamp: at(1700000000)},
+			},
+		},
+		{
+			name:      "value field is the measurement",
+			line:      "temperature,room=kitchen value=21.5 1700000000",
+			precision: lineprotocol.Second,
+			want:      model.Samples{{Metric: model.Metric{"__name__": "temperature", "room": "kitchen"}, Value: 21.5, Timestamp: at(1700000000)}},
+		},
+		{
+			name:      "names and tags sanitized",
+			line:      "disk.io,mount-point=/var,2nd=x read.bytes=1 1700000000000",
+			precision: lineprotocol.Millisecond,
+			want:      model.Samples{{Metric: model.Metric{"__name__": "disk_io_read_bytes", "mount_point": "/var", "_2nd": "x"}, Value: 1, Timestamp: at(1700000000)}},
+		},
+		{
+			name:      "microseconds",
+			line:      "up value=1 1700000000000000",
+			precision: lineprotocol.Microsecond,
+			want:      model.Samples{{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: at(1700000000)}},
+		},
+		{
+			name:      "value types",
+			line:      "m f=1.5,i=-2i,u=3u,t=true,b=F,s=\"text\" 1700000000",
+			precision: lineprotocol.Second,
+			want: model.Samples{
+				{Metric: model.Metric{"__name__": "m_f"}, Value: 1.5, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "m_i"}, Value: -2, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "m_u"}, Value: 3, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "m_t"}, Value: 1, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "m_b"}, Value: 0, Timestamp: at(1700000000)},
+			},
+			// String fields have no sample value
+			skipped: 1,
+		},
+		{
+			name:      "no timestamp",
+			line:      "up value=1",
+			precision: lineprotocol.Second,
+			want:      model.Samples{{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: model.TimeFromUnixNano(now.UnixNano())}},
+		},
+		{
+			name:      "lines",
+			line:      "a value=1 1700000000\n\n# comment\nb value=2 1700000001\n",
+			precision: lineprotocol.Second,
+			want: model.Samples{
+				{Metric: model.Metric{"__name__": "a"}, Value: 1, Timestamp: at(1700000000)},
+				{Metric: model.Metric{"__name__": "b"}, Value: 2, Timestamp: at(1700000001)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := Parse([]byte(tt.line), tt.precision, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != tt.skipped {
+				t.Errorf("skipped = %d, want %d", skipped, tt.skipped)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("samples\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "no fields", body: "cpu,host=a 1700000000", want: "at line 1:"},
+		// A single malformed line rejects the request, earlier lines included
+		{name: "second line", body: "cpu value=1 1700000000\ncpu value= 1700000000", want: "at line 2:"},
+		{name: "bad timestamp", body: "cpu value=1 17OO", want: "at line 1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, _, err := Parse([]byte(tt.body), lineprotocol.Second, time.Now())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+			if samples != nil {
+				t.Errorf("samples = %v, want none", samples)
+			}
+		})
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	tests := []struct {
+		precision string
+		want      lineprotocol.Precision
+		wantErr   string
+	}{
+		{precision: "", want: lineprotocol.Nanosecond},
+		{precision: "ns", want: lineprotocol.Nanosecond},
+		{precision: "us", want: lineprotocol.Microsecond},
+		{precision: "ms", want: lineprotocol.Millisecond},
+		{precision: "S", want: lineprotocol.Second},
+		{precision: "h", wantErr: "Unknown precision"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrecision(tt.precision)
+		if tt.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("ParsePrecision(%q) error = %v, want %q", tt.precision, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePrecision(%q) = %v, %v, want %v", tt.precision, got, err, tt.want)
+		}
+	}
+}
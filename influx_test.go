@@ -0,0 +1,43 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxMalformedLine(t *testing.T) {
+	body := "cpu,host=a usage=1 1700000000\ncpu,host=b usage= 1700000000\n"
+	req := httptest.NewRequest(http.MethodPost, "/write?precision=s", strings.NewReader(body))
+	rec, w := serveRequest(requestLimits{}, influxHandler, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp influxError
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code != "invalid" || !strings.Contains(resp.Message, "line 2") {
+		t.Errorf("response = %s, want an invalid error naming line 2", rec.Body)
+	}
+	// The valid first line is not written either
+	if len(w.samples) != 0 {
+		t.Errorf("%d samples written, want none", len(w.samples))
+	}
+}
@@ -0,0 +1,447 @@
+// Package kafka sends Prometheus samples to Kafka topics and the Event Hubs
+// Kafka endpoint.
+package kafka
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	connstr "github.com/Azure/azure-amqp-common-go/v4/conn"
+	"github.com/prometheus/common/model"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/payload"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/registry"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/token"
+)
+
+const (
+	// SASLPlain authenticates with a username and password.
+	SASLPlain = "plain"
+	// SASLOAuthBearer authenticates with an Azure Active Directory token.
+	SASLOAuthBearer = "oauthbearer"
+	// SASLNone disables authentication.
+	SASLNone = "none"
+
+	// DefaultMaxBatchBytes is the default limit of a record batch, the Event Hubs limit.
+	DefaultMaxBatchBytes = 1000000
+	// eventHubsPort is the port of the Event Hubs Kafka endpoint.
+	eventHubsPort = "9093"
+	// connectionStringUser is the SASL PLAIN user of Event Hubs connection strings.
+	connectionStringUser = "$ConnectionString"
+	// maxJoinedErrors limits the distinct record errors kept in an aggregated error.
+	maxJoinedErrors = 5
+	// connectTimeout limits fetching the topic metadata when the writer is created.
+	connectTimeout = 20 * time.Second
+)
+
+// Config for a Kafka topic
+type Config struct {
+	// Brokers are the bootstrap broker addresses, host:port. Derived from the
+	// Event Hubs namespace or connection string when empty.
+	Brokers []string
+	// Topic records are produced to. Defaults to the Event Hub name.
+	Topic string
+	// ConnString is an Event Hubs connection string, used with SASL PLAIN.
+	ConnString string
+	// Namespace is the Event Hubs namespace, ex. "foo" for "foo.servicebus.windows.net".
+	Namespace string
+	// Hub is the Event Hub name.
+	Hub string
+	// Mechanism is the SASL mechanism. Selected from the credentials when empty.
+	Mechanism string
+	// Username and Password for SASL PLAIN.
+	Username string
+	Password string
+	// Token for SASL OAUTHBEARER.
+	Token token.Config
+	// TokenResource is the Azure Active Directory resource of OAUTHBEARER
+	// tokens. Defaults to the https URL of the first broker host.
+	TokenResource string
+	// TLS enables TLS, always enabled for Event Hubs.
+	TLS bool
+	// ClientID identifies the adapter to the brokers.
+	ClientID string
+	// Acks is the number of acknowledgements required, 1 (leader) or -1 (all replicas).
+	Acks int
+	// Timeout for connections and requests, and for the delivery of records.
+	Timeout time.Duration
+	// MaxBatchBytes limits the size of the record batch of a partition in a request.
+	MaxBatchBytes int
+	// PartKeyLabel is the label used as record key.
+	PartKeyLabel string
+	Serializer   serializers.SerializerConfig
+	Registry     registry.Config
+	CloudEvents  cloudevents.Config
+	Compression  string
+}
+
+// eventHubs fills the brokers, topic and credentials of an Event Hubs namespace
+func (cfg *Config) eventHubs() error {
+	if len(cfg.Brokers) > 0 {
+		return nil
+	}
+
+	switch {
+	case cfg.ConnString != "":
+		parsed, err := connstr.ParsedConnectionFromStr(cfg.ConnString)
+		if err != nil {
+			return err
+		}
+		cfg.Brokers = []string{net.JoinHostPort(parsed.Namespace+"."+parsed.Suffix, eventHubsPort)}
+		if cfg.Topic == "" {
+			cfg.Topic = parsed.HubName
+		}
+		if cfg.Mechanism == "" {
+			cfg.Mechanism = SASLPlain
+			cfg.Username = connectionStringUser
+			cfg.Password = cfg.ConnString
+		}
+	case cfg.Namespace != "":
+		cfg.Brokers = []string{net.JoinHostPort(cfg.Namespace+".servicebus.windows.net", eventHubsPort)}
+		if cfg.Topic == "" {
+			cfg.Topic = cfg.Hub
+		}
+	default:
+		return errors.New("kafka brokers must not be empty")
+	}
+
+	// The Event Hubs Kafka endpoint only accepts TLS connections
+	cfg.TLS = true
+	return nil
+}
+
+// Writer sends Prometheus samples to a Kafka topic
+type Writer struct {
+	client       *kgo.Client
+	topic        string
+	timeout      time.Duration
+	partKeyLabel string
+	encoder      *payload.Encoder
+}
+
+// NewWriter creates a Kafka writer and fetches the partitions of its topic
+func NewWriter(cfg *Config) (*Writer, error) {
+	if err := cfg.eventHubs(); err != nil {
+		return nil, err
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("kafka topic must not be empty")
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		// Records with a key are partitioned by its murmur2 hash like the Java
+		// client, records without stick to a partition per batch
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		// Values are compressed with the configured codec and marked with a header
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		// Not supported by the Event Hubs Kafka endpoint
+		kgo.DisableIdempotentWrite(),
+	}
+	switch cfg.Acks {
+	case 1:
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()))
+	case -1:
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	default:
+		return nil, fmt.Errorf("kafka acks must be 1 or -1, not %d", cfg.Acks)
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts,
+			kgo.DialTimeout(cfg.Timeout),
+			kgo.RetryTimeout(cfg.Timeout),
+			kgo.ProduceRequestTimeout(cfg.Timeout),
+		)
+	}
+	maxBatchBytes := cfg.MaxBatchBytes
+	if maxBatchBytes <= 0 {
+		maxBatchBytes = DefaultMaxBatchBytes
+	}
+	opts = append(opts, kgo.ProducerBatchMaxBytes(int32(maxBatchBytes)))
+	if cfg.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+
+	mechanism, err := newMechanism(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+
+	encoder, err := payload.New(&payload.Config{
+		Serializer:  cfg.Serializer,
+		Registry:    cfg.Registry,
+		CloudEvents: cfg.CloudEvents,
+		Compression: cfg.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		client:       client,
+		topic:        cfg.Topic,
+		timeout:      cfg.Timeout,
+		partKeyLabel: cfg.PartKeyLabel,
+		encoder:      encoder,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := w.Ping(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write produces a record for each sample
+//
+// returns the outcome of each sample and, when records were not delivered, an error.
+func (w *Writer) Write(ctx context.Context, samples model.Samples) (remote.Result, error) {
+	var result remote.Result
+
+	// Stop processing if empty
+	if len(samples) == 0 {
+		return result, nil
+	}
+
+	begin := time.Now()
+
+	records := make([]*kgo.Record, 0, len(samples))
+	for _, sample := range samples {
+		rec, size, err := w.newRecord(sample)
+		if errors.Is(err, serializers.ErrDropped) {
+			result.Dropped++
+			continue
+		}
+		if err != nil {
+			log.ErrorObj(err).Msg("Could not serialize sample")
+			result.SerializeFailed++
+			continue
+		}
+
+		result.Bytes += size
+		result.CompressedBytes += len(rec.Value)
+		records = append(records, rec)
+	}
+
+	err := w.produce(ctx, records, &result)
+
+	duration := time.Since(begin).Seconds()
+	log.Debug().Int("count", len(samples)).Int("sent", result.Sent).Int("serialize_failed", result.SerializeFailed).Int("send_failed", result.SendFailed).Int("dropped", result.Dropped).Float64("duration_sec", duration).Msg("Wrote samples as kafka records")
+
+	return result, err
+}
+
+// newRecord serializes a sample into a record
+//
+// returns the record and the size of its value before compression.
+func (w *Writer) newRecord(sample *model.Sample) (*kgo.Record, int, error) {
+	properties := make(map[string]interface{}, w.encoder.Properties())
+	value, size, err := w.encoder.Encode(sample, properties)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rec := &kgo.Record{
+		Value:     value,
+		Headers:   newHeaders(properties, w.encoder.Enveloped()),
+		Timestamp: time.UnixMilli(int64(sample.Timestamp)),
+	}
+	if key, ok := routing.PartitionKey(sample.Metric, w.partKeyLabel); ok {
+		rec.Key = []byte(key)
+	}
+
+	return rec, size, nil
+}
+
+// newHeaders converts properties into record headers sorted by name
+//
+// CloudEvents properties follow the Kafka binding: the content type becomes the
+// content-type header and the AMQP binary mode attributes become ce_ headers.
+func newHeaders(properties map[string]interface{}, enveloped bool) []kgo.RecordHeader {
+	headers := make([]kgo.RecordHeader, 0, len(properties))
+	for name, value := range properties {
+		if enveloped {
+			switch {
+			case name == payload.ContentTypeProperty:
+				name = cloudevents.KafkaContentTypeHeader
+			case strings.HasPrefix(name, cloudevents.PropertyPrefix):
+				name = cloudevents.KafkaHeaderPrefix + strings.TrimPrefix(name, cloudevents.PropertyPrefix)
+			}
+		}
+		headers = append(headers, kgo.RecordHeader{Key: name, Value: []byte(fmt.Sprint(value))})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Key < headers[j].Key })
+	return headers
+}
+
+// produce sends records and waits for their delivery, at most the timeout
+//
+// The client's record timeout is not used, it counts from the record
+// timestamp, which is the sample timestamp.
+func (w *Writer) produce(ctx context.Context, records []*kgo.Record, result *remote.Result) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	var errs []error
+	for _, r := range w.client.ProduceSync(ctx, records...) {
+		if r.Err == nil {
+			result.Sent++
+			continue
+		}
+		result.SendFailed++
+		if len(errs) < maxJoinedErrors && !containsError(errs, r.Err) {
+			errs = append(errs, r.Err)
+		}
+	}
+
+	if result.SendFailed > 0 {
+		return fmt.Errorf("produce %d of %d records to topic '%s' failed: %w", result.SendFailed, len(records), w.topic, errors.Join(errs...))
+	}
+	return nil
+}
+
+// containsError reports whether errs holds an error with the message of err
+func containsError(errs []error, err error) bool {
+	for _, e := range errs {
+		if e.Error() == err.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close shuts down any active connections
+func (w *Writer) Close(ctx context.Context) error {
+	w.client.Close()
+	return nil
+}
+
+// Name identifies the topic
+func (w *Writer) Name() string {
+	return w.topic
+}
+
+// Ping checks the connection to the brokers by requesting the topic metadata
+func (w *Writer) Ping(ctx context.Context) error {
+	req := kmsg.NewPtrMetadataRequest()
+	topic := kmsg.NewMetadataRequestTopic()
+	topic.Topic = kmsg.StringPtr(w.topic)
+	req.Topics = append(req.Topics, topic)
+
+	resp, err := req.RequestWith(ctx, w.client)
+	if err != nil {
+		return fmt.Errorf("kafka metadata: %w", err)
+	}
+	for _, t := range resp.Topics {
+		if t.Topic == nil || *t.Topic != w.topic {
+			continue
+		}
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			return fmt.Errorf("kafka topic '%s': %w", w.topic, err)
+		}
+		if len(t.Partitions) == 0 {
+			return fmt.Errorf("kafka topic '%s' has no partitions", w.topic)
+		}
+		return nil
+	}
+	return fmt.Errorf("kafka topic '%s' not found", w.topic)
+}
+
+// newMechanism returns the SASL mechanism of the config, nil without authentication
+func newMechanism(cfg *Config) (sasl.Mechanism, error) {
+	mechanism := strings.ToLower(cfg.Mechanism)
+	if mechanism == "" {
+		switch {
+		case cfg.Username != "":
+			mechanism = SASLPlain
+		case cfg.Token.Enabled():
+			mechanism = SASLOAuthBearer
+		default:
+			mechanism = SASLNone
+		}
+	}
+
+	switch mechanism {
+	case SASLNone:
+		return nil, nil
+	case SASLPlain:
+		return plain.Auth{User: cfg.Username, Pass: cfg.Password}.AsMechanism(), nil
+	case SASLOAuthBearer:
+		resource := cfg.TokenResource
+		if resource == "" {
+			host, _, err := net.SplitHostPort(cfg.Brokers[0])
+			if err != nil {
+				return nil, err
+			}
+			resource = "https://" + host
+		}
+		provider, err := token.NewProvider(&cfg.Token, resource)
+		if err != nil {
+			return nil, err
+		}
+		return oauth.Oauth(func(ctx context.Context) (oauth.Auth, error) {
+			bearer, err := provider.Token(ctx)
+			if err != nil {
+				return oauth.Auth{}, fmt.Errorf("kafka token: %w", err)
+			}
+			return oauth.Auth{Token: bearer}, nil
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown kafka SASL mechanism '%s'", cfg.Mechanism)
+	}
+}
@@ -0,0 +1,389 @@
+package kafka
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+const testTopic = "metrics"
+
+// newCluster starts an in-process Kafka cluster with a topic of three partitions
+func newCluster(t *testing.T, opts ...kfake.Opt) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(append([]kfake.Opt{kfake.NumBrokers(2), kfake.SeedTopics(3, testTopic)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+func testConfig(cluster *kfake.Cluster) *Config {
+	return &Config{
+		Brokers:      cluster.ListenAddrs(),
+		Topic:        testTopic,
+		ClientID:     "adapter-test",
+		Acks:         -1,
+		Timeout:      5 * time.Second,
+		PartKeyLabel: "instance",
+		Serializer: serializers.SerializerConfig{
+			DataFormat: "json",
+			Fields:     record.DefaultFields(),
+		},
+	}
+}
+
+func newTestWriter(t *testing.T, cfg *Config) *Writer {
+	t.Helper()
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close(context.Background()) })
+	return w
+}
+
+// consume reads n records of the test topic from the start
+func consume(t *testing.T, cluster *kfake.Cluster, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(testTopic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("consumed %d of %d records: %v", len(records), n, err)
+		}
+		fetches.EachRecord(func(r *kgo.Record) {
+			records = append(records, r)
+		})
+	}
+	return records
+}
+
+// header returns the value of a record header
+func header(r *kgo.Record, key string) (string, bool) {
+	for _, h := range r.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+func testSamples() model.Samples {
+	ts := model.Time(1700000000000)
+	return model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "a:9100"}, Value: 1, Timestamp: ts},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "b:9100"}, Value: 0, Timestamp: ts + 1},
+		{Metric: model.Metric{model.MetricNameLabel: "load1", "instance": "a:9100"}, Value: 0.5, Timestamp: ts + 2},
+		{Metric: model.Metric{model.MetricNameLabel: "load1"}, Value: 0.25, Timestamp: ts + 3},
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	cluster := newCluster(t)
+	w := newTestWriter(t, testConfig(cluster))
+
+	samples := testSamples()
+	result, err := w.Write(context.Background(), samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != len(samples) || result.SendFailed != 0 {
+		t.Errorf("result = %+v, want %d sent", result, len(samples))
+	}
+	if result.Bytes == 0 || result.CompressedBytes != result.Bytes {
+		t.Errorf("bytes = %d, compressed = %d, want equal sizes without compression", result.Bytes, result.CompressedBytes)
+	}
+
+	records := consume(t, cluster, len(samples))
+	partitions := make(map[string]int32)
+	for _, r := range records {
+		var value map[string]interface{}
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			t.Fatalf("record value %q is not json: %v", r.Value, err)
+		}
+		if contentType, _ := header(r, "Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type header = %q", contentType)
+		}
+		if _, ok := header(r, compression.ContentEncodingProperty); ok {
+			t.Error("Content-Encoding header without compression")
+		}
+		if r.Timestamp.UnixMilli() < 1700000000000 || r.Timestamp.UnixMilli() > 1700000000003 {
+			t.Errorf("timestamp = %v, want the sample timestamp", r.Timestamp)
+		}
+
+		// Records of an instance share a partition
+		if r.Key == nil {
+			continue
+		}
+		if p, ok := partitions[string(r.Key)]; ok && p != r.Partition {
+			t.Errorf("key %q in partitions %d and %d", r.Key, p, r.Partition)
+		}
+		partitions[string(r.Key)] = r.Partition
+	}
+	if len(partitions) != 2 {
+		t.Errorf("keys = %v, want a:9100 and b:9100", partitions)
+	}
+}
+
+func TestWriteKeyPartition(t *testing.T) {
+	cluster := newCluster(t)
+	w := newTestWriter(t, testConfig(cluster))
+
+	sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "a:9100"}, Value: 1}
+	if _, err := w.Write(context.Background(), model.Samples{sample}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The murmur2 partition of the Java client, (murmur2("a:9100") & 0x7fffffff) % 3
+	records := consume(t, cluster, 1)
+	want := int32(kafkaMurmur2([]byte("a:9100")) & 0x7fffffff % 3)
+	if records[0].Partition != want {
+		t.Errorf("partition = %d, want %d", records[0].Partition, want)
+	}
+}
+
+func TestWriteCompressionAndCloudEvents(t *testing.T) {
+	cluster := newCluster(t)
+	cfg := testConfig(cluster)
+	cfg.Compression = "gzip"
+	cfg.CloudEvents = cloudevents.Config{Mode: cloudevents.StructuredMode, Source: "/adapter"}
+	w := newTestWriter(t, cfg)
+
+	result, err := w.Write(context.Background(), testSamples()[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CompressedBytes == result.Bytes {
+		t.Errorf("compressed bytes = bytes = %d", result.Bytes)
+	}
+
+	r := consume(t, cluster, 1)[0]
+	if encoding, _ := header(r, compression.ContentEncodingProperty); encoding != "gzip" {
+		t.Errorf("Content-Encoding header = %q, want gzip", encoding)
+	}
+	if contentType, _ := header(r, cloudevents.KafkaContentTypeHeader); contentType != cloudevents.ContentType {
+		t.Errorf("content-type header = %q, want the structured CloudEvents content type", contentType)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(r.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("record value %q is not a CloudEvent: %v", data, err)
+	}
+	if event["specversion"] != "1.0" || event["source"] != "/adapter" {
+		t.Errorf("event = %v", event)
+	}
+}
+
+func TestWriteCloudEventsBinary(t *testing.T) {
+	cluster := newCluster(t)
+	cfg := testConfig(cluster)
+	cfg.CloudEvents = cloudevents.Config{Mode: cloudevents.BinaryMode, Source: "/adapter", Type: "io.prometheus.sample", Subject: cloudevents.DefaultSubject}
+	w := newTestWriter(t, cfg)
+
+	if _, err := w.Write(context.Background(), testSamples()[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Headers of the Kafka binding, not the AMQP binding
+	r := consume(t, cluster, 1)[0]
+	want := map[string]string{
+		"content-type":   "application/json",
+		"ce_specversion": "1.0",
+		"ce_source":      "/adapter",
+		"ce_type":        "io.prometheus.sample",
+		"ce_subject":     "up",
+	}
+	for key, value := range want {
+		if got, _ := header(r, key); got != value {
+			t.Errorf("header %s = %q, want %q", key, got, value)
+		}
+	}
+	for _, key := range []string{"ce_id", "ce_time"} {
+		if got, _ := header(r, key); got == "" {
+			t.Errorf("header %s missing", key)
+		}
+	}
+	for _, h := range r.Headers {
+		if h.Key == "Content-Type" || strings.HasPrefix(h.Key, cloudevents.PropertyPrefix) {
+			t.Errorf("AMQP binding header %s", h.Key)
+		}
+	}
+}
+
+func TestSASLPlain(t *testing.T) {
+	cluster := newCluster(t, kfake.EnableSASL(), kfake.Superuser("PLAIN", "adapter", "secret"))
+
+	cfg := testConfig(cluster)
+	cfg.Username, cfg.Password = "adapter", "secret"
+	w := newTestWriter(t, cfg)
+	if _, err := w.Write(context.Background(), testSamples()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = testConfig(cluster)
+	cfg.Username, cfg.Password = "adapter", "wrong"
+	cfg.Timeout = time.Second
+	if w, err := NewWriter(cfg); err == nil {
+		w.Close(context.Background())
+		t.Fatal("writer with a wrong password was created")
+	}
+}
+
+func TestNewWriterErrors(t *testing.T) {
+	cluster := newCluster(t)
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   error
+		msg    string
+	}{
+		{
+			name:   "unknown topic",
+			modify: func(cfg *Config) { cfg.Topic = "missing" },
+			want:   kerr.UnknownTopicOrPartition,
+		},
+		{
+			name:   "acks",
+			modify: func(cfg *Config) { cfg.Acks = 0 },
+			msg:    "kafka acks must be 1 or -1, not 0",
+		},
+		{
+			name:   "mechanism",
+			modify: func(cfg *Config) { cfg.Mechanism = "SCRAM-SHA-256" },
+			msg:    "unknown kafka SASL mechanism 'SCRAM-SHA-256'",
+		},
+		{
+			name:   "no brokers",
+			modify: func(cfg *Config) { cfg.Brokers = nil },
+			msg:    "kafka brokers must not be empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(cluster)
+			tt.modify(cfg)
+			w, err := NewWriter(cfg)
+			if err == nil {
+				w.Close(context.Background())
+				t.Fatal("writer was created")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+			if tt.msg != "" && err.Error() != tt.msg {
+				t.Errorf("error = %q, want %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestWriteFailed(t *testing.T) {
+	cluster := newCluster(t)
+	cfg := testConfig(cluster)
+	cfg.Timeout = time.Second
+	w := newTestWriter(t, cfg)
+
+	cluster.Close()
+	samples := testSamples()
+	result, err := w.Write(context.Background(), samples)
+	if err == nil || !strings.HasPrefix(err.Error(), "produce 4 of 4 records to topic 'metrics' failed: ") {
+		t.Fatalf("error = %v", err)
+	}
+	if result.Sent != 0 || result.SendFailed != len(samples) {
+		t.Errorf("result = %+v, want %d failed", result, len(samples))
+	}
+}
+
+// kafkaMurmur2 is the murmur2 hash of the Java client, the reference of the expected partitions
+func kafkaMurmur2(data []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
@@ -0,0 +1,115 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/pflag"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+)
+
+// kqlCommand prints the Azure Data Explorer commands creating the tables and
+// ingestion mappings matching the configured serializer.
+//
+// Usage: kql [--table NAME] [--update-policy] [METRIC ...]
+//
+// The main table receives batch events and single events routed to the fallback
+// table. Each METRIC gets its own table named by the single event routing
+// templates, either ingested directly with its own mapping or, with
+// --update-policy, populated from the main table by an update policy.
+func kqlCommand(out io.Writer, args []string) error {
+	cfg := getWriterConfig()
+
+	flags := pflag.NewFlagSet("kql", pflag.ContinueOnError)
+	table := flags.String("table", cfg.ADXFallback, "Main table receiving batch events and the update policy source.")
+	updatePolicy := flags.Bool("update-policy", false, "Populate per-metric tables from the main table using update policies.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ser, err := serializers.NewSerializer(&cfg.Serializer)
+	if err != nil {
+		return err
+	}
+
+	format := ser.ADXFormat()
+	cols := ser.ADXColumns()
+	if len(cols) == 0 {
+		return fmt.Errorf("serializer '%s' does not produce an Azure Data Explorer format", cfg.Serializer.DataFormat)
+	}
+
+	router, err := routing.New(cfg.RoutingConfig())
+	if err != nil {
+		return err
+	}
+
+	mainTable := kusto.TableName(*table)
+	if mainTable == "" {
+		return errors.New("main table name is not valid")
+	}
+
+	fmt.Fprintf(out, "// Serializer '%s', data format '%s'\n\n", cfg.Serializer.DataFormat, format)
+	fmt.Fprintln(out, "// Main table")
+	fmt.Fprintln(out, kusto.CreateTable(mainTable, cols))
+	fmt.Fprintln(out)
+
+	mapping, err := kusto.CreateMapping(mainTable, router.Mapping(routing.Data{}), format, cols)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, mapping)
+
+	for _, metric := range flags.Args() {
+		data := routing.Data{Name: metric, Labels: map[string]string{}}
+		metricTable := router.Table(data)
+
+		fmt.Fprintf(out, "\n// Metric '%s'\n", metric)
+		fmt.Fprintln(out, kusto.CreateTable(metricTable, cols))
+		fmt.Fprintln(out)
+
+		if *updatePolicy {
+			query, err := kusto.MetricQuery(mainTable, metric, cols)
+			if err != nil {
+				return err
+			}
+			policy, err := kusto.AlterUpdatePolicy(metricTable, kusto.UpdatePolicy{
+				IsEnabled: true,
+				Source:    mainTable,
+				Query:     query,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out, policy)
+			continue
+		}
+
+		mapping, err := kusto.CreateMapping(metricTable, router.Mapping(data), format, cols)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, mapping)
+	}
+
+	return nil
+}
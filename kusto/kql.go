@@ -0,0 +1,140 @@
+package kusto
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Column describes a table column and where its value is found in an event.
+type Column struct {
+	// Name of the table column.
+	Name string
+	// Type is the Kusto scalar data type, ex. "datetime", "real", "string", "dynamic".
+	Type string
+	// Path is the JSON path (json format), field name (avro format) or ordinal (csv format) of the value.
+	Path string
+	// MetricName marks the column holding the Prometheus metric name.
+	MetricName bool
+}
+
+// UpdatePolicy is an Azure Data Explorer table update policy.
+//
+// See [ https://docs.microsoft.com/en-us/azure/data-explorer/kusto/management/updatepolicy ]
+type UpdatePolicy struct {
+	IsEnabled                    bool
+	Source                       string
+	Query                        string
+	IsTransactional              bool
+	PropagateIngestionProperties bool
+}
+
+// QuoteName quotes an entity name for use in KQL.
+func QuoteName(name string) string {
+	return "['" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name) + "']"
+}
+
+// QuoteString quotes a string literal for use in KQL.
+func QuoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`).Replace(s) + "'"
+}
+
+// JSONPath returns the JSON path of a top-level field for use in ingestion mappings.
+func JSONPath(field string) string {
+	for _, r := range field {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return "$['" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(field) + "']"
+		}
+	}
+	return "$." + field
+}
+
+// CreateTable returns the command creating (or extending) a table with the given columns.
+func CreateTable(table string, cols []Column) string {
+	defs := make([]string, 0, len(cols))
+	for _, col := range cols {
+		defs = append(defs, QuoteName(col.Name)+":"+col.Type)
+	}
+	return fmt.Sprintf(".create-merge table %s (%s)", QuoteName(table), strings.Join(defs, ", "))
+}
+
+// CreateMapping returns the command creating (or replacing) an ingestion mapping for the given columns.
+// returns an error if the format does not support ingestion mappings.
+func CreateMapping(table, mapping string, format DataFormat, cols []Column) (string, error) {
+	type mappingColumn struct {
+		Column     string            `json:"column"`
+		Properties map[string]string `json:"Properties"`
+	}
+
+	var key string
+	switch format {
+	case JSONFormat:
+		key = "Path"
+	case AVROFormat:
+		key = "Field"
+	case CSVFormat:
+		key = "Ordinal"
+	default:
+		return "", fmt.Errorf("no ingestion mapping for data format '%s'", format)
+	}
+
+	defs := make([]mappingColumn, 0, len(cols))
+	for i, col := range cols {
+		path := col.Path
+		if format == CSVFormat && path == "" {
+			path = strconv.Itoa(i)
+		}
+		defs = append(defs, mappingColumn{Column: col.Name, Properties: map[string]string{key: path}})
+	}
+
+	buf, err := json.Marshal(defs)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(".create-or-alter table %s ingestion %s mapping %s %s", QuoteName(table), format, QuoteString(mapping), QuoteString(string(buf))), nil
+}
+
+// AlterUpdatePolicy returns the command setting the update policy of a table.
+func AlterUpdatePolicy(table string, policy UpdatePolicy) (string, error) {
+	buf, err := json.Marshal([]UpdatePolicy{policy})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(".alter table %s policy update %s", QuoteName(table), QuoteString(string(buf))), nil
+}
+
+// MetricQuery returns a query selecting the rows of a single metric from a source table.
+// returns an error if no column holds the metric name.
+func MetricQuery(source, metric string, cols []Column) (string, error) {
+	var nameCol string
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if col.MetricName {
+			nameCol = col.Name
+		}
+		names = append(names, QuoteName(col.Name))
+	}
+	if nameCol == "" {
+		return "", fmt.Errorf("no metric name column in table %s", source)
+	}
+
+	return fmt.Sprintf("%s | where %s == %s | project %s", QuoteName(source), QuoteName(nameCol), QuoteString(metric), strings.Join(names, ", ")), nil
+}
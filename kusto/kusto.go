@@ -36,6 +36,9 @@ const (
 	AVROFormat
 	// NoFormat defines an absent format.
 	NoFormat
+	// ProtobufFormat defines the protobuf data format.
+	// Not supported by Azure Data Explorer injestion.
+	ProtobufFormat
 )
 
 func (km DataFormat) String() string {
@@ -46,11 +49,23 @@ func (km DataFormat) String() string {
 		return "json"
 	case AVROFormat:
 		return "avro"
+	case ProtobufFormat:
+		return "protobuf"
 	default:
 		return ""
 	}
 }
 
+// IsADX reports whether the format can be ingested by Azure Data Explorer.
+func (km DataFormat) IsADX() bool {
+	switch km {
+	case CSVFormat, JSONFormat, AVROFormat:
+		return true
+	default:
+		return false
+	}
+}
+
 // ParseDataFormat converts a Kusto Data Format string into a kusto.DataFormat value.
 // returns an error if the input string does not match known values.
 func ParseDataFormat(formatStr string) (DataFormat, error) {
@@ -61,6 +76,8 @@ func ParseDataFormat(formatStr string) (DataFormat, error) {
 		return JSONFormat, nil
 	case "avro":
 		return AVROFormat, nil
+	case "protobuf":
+		return ProtobufFormat, nil
 	default:
 		return NoFormat, fmt.Errorf("Unknown Kusto Data Format: '%s'", strings.ToLower(formatStr))
 	}
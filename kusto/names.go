@@ -0,0 +1,58 @@
+package kusto
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"strings"
+)
+
+const (
+	// MaxTableNameLength is the longest entity name accepted by Azure Data Explorer.
+	//
+	// See [ https://docs.microsoft.com/en-us/azure/data-explorer/kusto/query/schema-entities/entity-names ]
+	MaxTableNameLength = 1024
+)
+
+// TableName converts a string into a valid Azure Data Explorer table name.
+//
+// Characters outside of letters, digits and underscore are replaced with an
+// underscore, and the result is truncated to MaxTableNameLength. Names may
+// start with a digit, so table names are always written with QuoteName in KQL.
+// returns an empty string if no usable characters remain.
+func TableName(name string) string {
+	name = strings.TrimSpace(name)
+
+	var b strings.Builder
+	b.Grow(len(name))
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+		if b.Len() >= MaxTableNameLength {
+			break
+		}
+	}
+
+	sanitized := b.String()
+	if strings.Trim(sanitized, "_") == "" {
+		return ""
+	}
+	return sanitized
+}
@@ -0,0 +1,50 @@
+package kusto
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "node_cpu_seconds_total", want: "node_cpu_seconds_total"},
+		{name: " http.requests-total ", want: "http_requests_total"},
+		// Quoted when used in KQL, not sent to the fallback table
+		{name: "1abc", want: "1abc"},
+		{name: "5xx:errors", want: "5xx_errors"},
+		{name: "...", want: ""},
+		{name: "", want: ""},
+		{name: strings.Repeat("a", MaxTableNameLength+10), want: strings.Repeat("a", MaxTableNameLength)},
+	}
+	for _, tt := range tests {
+		if got := TableName(tt.name); got != tt.want {
+			t.Errorf("TableName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreateTableQuotesName(t *testing.T) {
+	got := CreateTable(TableName("1abc"), []Column{{Name: "value", Type: "real"}})
+	if want := ".create-merge table ['1abc'] (['value']:real)"; got != want {
+		t.Errorf("CreateTable = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+)
+
+const (
+	// defaultMaxBodyBytes is the default limit of a compressed write request body.
+	defaultMaxBodyBytes = 16 << 20
+	// defaultMaxDecodedBytes is the default limit of a decompressed write request body.
+	defaultMaxDecodedBytes = 32 << 20
+)
+
+// Limit names, used as the "reason" of rejected requests
+const (
+	bodyBytesLimit    = "body_bytes"
+	decodedBytesLimit = "decoded_bytes"
+	seriesLimit       = "series"
+	samplesLimit      = "samples"
+)
+
+// requestLimits bound the resources used by a single write request.
+// A limit of 0 is disabled.
+type requestLimits struct {
+	BodyBytes    int64
+	DecodedBytes int
+	Series       int
+	Samples      int
+}
+
+// limitError is returned when a request exceeds one of the request limits.
+type limitError struct {
+	limit string
+	value int64
+	max   int64
+}
+
+func (e *limitError) Error() string {
+	if e.value < 0 {
+		return fmt.Sprintf("request exceeds %s limit of %d", e.limit, e.max)
+	}
+	return fmt.Sprintf("request %s %d exceeds limit of %d", e.limit, e.value, e.max)
+}
+
+// readBody reads and decompresses a request body within the limits
+//
+// defaultEncoding applies to requests without a Content-Encoding header.
+// returns a limitError if the body or the decompressed body is too large.
+func (l *requestLimits) readBody(c *gin.Context, defaultEncoding string) ([]byte, error) {
+	body := c.Request.Body
+	if l.BodyBytes > 0 {
+		// Reject early when the client announces the size
+		if c.Request.ContentLength > l.BodyBytes {
+			return nil, &limitError{limit: bodyBytesLimit, value: c.Request.ContentLength, max: l.BodyBytes}
+		}
+		body = http.MaxBytesReader(c.Writer, body, l.BodyBytes)
+	}
+
+	compressed, err := io.ReadAll(body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, &limitError{limit: bodyBytesLimit, value: -1, max: l.BodyBytes}
+		}
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+
+	encoding := c.GetHeader("Content-Encoding")
+	if encoding == "" {
+		encoding = defaultEncoding
+	}
+
+	buf, err := compression.Decode(encoding, compressed, l.DecodedBytes)
+	if errors.Is(err, compression.ErrTooLarge) {
+		return nil, &limitError{limit: decodedBytesLimit, value: -1, max: int64(l.DecodedBytes)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompress request body: %w", err)
+	}
+	return buf, nil
+}
+
+// checkWriteRequest checks the series and sample counts of a write request
+func (l *requestLimits) checkWriteRequest(req *prompb.WriteRequest) error {
+	samples := 0
+	for _, ts := range req.Timeseries {
+		samples += len(ts.Samples)
+	}
+	return l.checkCounts(len(req.Timeseries), samples)
+}
+
+// checkCounts checks the series and sample counts of a request
+func (l *requestLimits) checkCounts(series, samples int) error {
+	if l.Series > 0 && series > l.Series {
+		return &limitError{limit: seriesLimit, value: int64(series), max: int64(l.Series)}
+	}
+	if l.Samples > 0 && samples > l.Samples {
+		return &limitError{limit: samplesLimit, value: int64(samples), max: int64(l.Samples)}
+	}
+	return nil
+}
+
+// seriesCount returns the number of distinct series of samples
+func seriesCount(samples model.Samples) int {
+	series := make(map[model.Fingerprint]struct{}, len(samples))
+	for _, s := range samples {
+		series[s.Metric.Fingerprint()] = struct{}{}
+	}
+	return len(series)
+}
+
+// abortRequest ends a request which could not be read or decoded
+//
+// Requests over a limit are rejected with 413 and counted by reason.
+func abortRequest(c *gin.Context, err error) {
+	var limitErr *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		rejectedRequests.WithLabelValues(limitErr.limit).Inc()
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		log.Warn().Err(err).Str("limit", limitErr.limit).Int64("max", limitErr.max).Str("client", c.ClientIP()).Msg("write request rejected")
+	case errors.Is(err, compression.ErrUnsupported):
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		log.ErrorObj(err).Str("content_encoding", c.GetHeader("Content-Encoding")).Msg("write request rejected")
+	default:
+		c.AbortWithStatus(http.StatusBadRequest)
+		log.ErrorObj(err).Msg("write request failed")
+	}
+}
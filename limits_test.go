@@ -0,0 +1,201 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/otlp"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+// stubWriter records the samples written
+type stubWriter struct {
+	samples model.Samples
+}
+
+func (w *stubWriter) Write(ctx context.Context, samples model.Samples) (remote.Result, error) {
+	w.samples = append(w.samples, samples...)
+	return remote.Result{Sent: len(samples)}, nil
+}
+
+func (w *stubWriter) Name() string                    { return "stub" }
+func (w *stubWriter) Close(ctx context.Context) error { return nil }
+
+// truncatedReader returns data, then fails like a connection closed before the declared Content-Length
+type truncatedReader struct {
+	data io.Reader
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// writeRequest returns a snappy compressed remote write request of series with samples each
+func writeRequest(t *testing.T, series, samples int) []byte {
+	t.Helper()
+	var req prompb.WriteRequest
+	for i := 0; i < series; i++ {
+		ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: strings.Repeat("i", i+1)}}}
+		for j := 0; j < samples; j++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: 1, Timestamp: int64(j)})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	data, err := proto.Marshal(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+// serveRequest runs a handler with limits on a request
+func serveRequest(limits requestLimits, handler func(writer, *handlerSettings) func(*gin.Context), req *http.Request) (*httptest.ResponseRecorder, *stubWriter) {
+	gin.SetMode(gin.TestMode)
+	settings := &handlerSettings{}
+	settings.limits.Store(&limits)
+	settings.otlp.Store(&otlp.Options{})
+	w := &stubWriter{}
+
+	router := gin.New()
+	router.POST("/write", handler(w, settings))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec, w
+}
+
+func TestWriteRequestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  requestLimits
+		body    func(t *testing.T) io.Reader
+		length  int64
+		status  int
+		samples int
+	}{
+		{
+			name:    "within limits",
+			limits:  requestLimits{BodyBytes: 1 << 10, DecodedBytes: 1 << 10, Series: 2, Samples: 6},
+			body:    func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			status:  http.StatusOK,
+			samples: 6,
+		},
+		{
+			name:   "body over limit",
+			limits: requestLimits{BodyBytes: 16},
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			// Chunked requests are stopped while reading
+			name:   "body over limit without content length",
+			limits: requestLimits{BodyBytes: 16},
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			length: -1,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "decoded body over limit",
+			limits: requestLimits{DecodedBytes: 16},
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "series over limit",
+			limits: requestLimits{Series: 1},
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "samples over limit",
+			limits: requestLimits{Samples: 5},
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)) },
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			// A client error, not an adapter failure worth a retry
+			name: "truncated body",
+			body: func(t *testing.T) io.Reader {
+				return &truncatedReader{data: bytes.NewReader(writeRequest(t, 2, 3)[:10])}
+			},
+			length: -1,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "truncated snappy block",
+			body:   func(t *testing.T) io.Reader { return bytes.NewReader(writeRequest(t, 2, 3)[:10]) },
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/write", tt.body(t))
+			if tt.length != 0 {
+				req.ContentLength = tt.length
+			}
+			rec, w := serveRequest(tt.limits, writeHandler, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if len(w.samples) != tt.samples {
+				t.Errorf("%d samples written, want %d", len(w.samples), tt.samples)
+			}
+		})
+	}
+}
+
+func TestInfluxRequestLimits(t *testing.T) {
+	body := "cpu,host=a usage=1,idle=2 1\ncpu,host=b usage=3 1\n"
+	tests := []struct {
+		name   string
+		limits requestLimits
+		status int
+	}{
+		{name: "within limits", limits: requestLimits{Series: 3, Samples: 3}, status: http.StatusNoContent},
+		{name: "body over limit", limits: requestLimits{BodyBytes: 8}, status: http.StatusRequestEntityTooLarge},
+		// Every field is a series
+		{name: "series over limit", limits: requestLimits{Series: 2}, status: http.StatusRequestEntityTooLarge},
+		{name: "samples over limit", limits: requestLimits{Samples: 2}, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/write?precision=s", strings.NewReader(body))
+			rec, _ := serveRequest(tt.limits, influxHandler, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
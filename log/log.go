@@ -171,23 +171,33 @@ func Ctx(ctx context.Context) *zerolog.Logger {
 // sets the Global Level to the parsed level.
 // returns an error if the input string does not match known values.
 func SetLevel(levelStr string) error {
+	level, err := ParseLevel(levelStr)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(level)
+	return nil
+}
+
+// ParseLevel converts a level string into a zerolog Level value
+// returns an error if the input string does not match known values.
+func ParseLevel(levelStr string) (zerolog.Level, error) {
 	switch strings.ToLower(levelStr) {
 	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		return zerolog.DebugLevel, nil
 	case "info":
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+		return zerolog.InfoLevel, nil
 	case "warn":
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+		return zerolog.WarnLevel, nil
 	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+		return zerolog.ErrorLevel, nil
 	case "fatal":
-		zerolog.SetGlobalLevel(zerolog.FatalLevel)
+		return zerolog.FatalLevel, nil
 	case "panic":
-		zerolog.SetGlobalLevel(zerolog.PanicLevel)
+		return zerolog.PanicLevel, nil
 	case "none":
-		zerolog.SetGlobalLevel(zerolog.Disabled)
+		return zerolog.Disabled, nil
 	default:
-		return fmt.Errorf("Unknown Level String: '%s'", strings.ToLower(levelStr))
+		return zerolog.NoLevel, fmt.Errorf("Unknown Level String: '%s'", strings.ToLower(levelStr))
 	}
-	return nil
 }
@@ -26,8 +26,7 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
-	"math"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -36,21 +35,30 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/adx"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/hub"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kafka"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
 )
 
 const (
 	// AppName is the application name. Value is static and will not change.
 	AppName                            = "prometheus-eventhubs-adapter"
-	defaultNaNValue   float64          = 0
 	defaultMetricName model.LabelValue = "no_name"
+
+	// eventHubDestination writes samples to Event Hubs.
+	eventHubDestination = "eventhub"
+	// kafkaDestination writes samples to Kafka or the Event Hubs Kafka endpoint.
+	kafkaDestination = "kafka"
+	// adxDestination ingests samples directly into Azure Data Explorer.
+	adxDestination = "adx"
 )
 
 // Build information. Populated at compile-time using -ldflags "-X main.BUILD=value"
@@ -64,13 +72,56 @@ var (
 )
 
 func main() {
+	initConfig()
+
+	// Subcommands
+	switch command := pflag.Arg(0); command {
+	case "":
+		// Run adapter
+	case "kql":
+		if err := kqlCommand(os.Stdout, pflag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate KQL")
+		}
+		return
+	case "validate":
+		if err := validateCommand(os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatal().Str("command", command).Msg("Unknown command")
+	}
+
+	// Strict configuration, the adapter does not start with invalid settings
+	problems, warnings := splitWarnings(validateConfig())
+	logWarnings(warnings)
+	if len(problems) > 0 {
+		printProblems(os.Stderr, problems)
+		log.Fatal().Int("problems", len(problems)).Msg("Invalid configuration")
+	}
+
 	log.Info().Str("version", Version).Str("commit", Commit).Str("build", Build).Msgf("%s starting", AppName)
 	adapterInfo.WithLabelValues(AppName, Version, Commit, Build).Set(1)
-	initConfig()
 
-	writeHub, err := hub.NewClient(getWriterConfig())
+	settings := getWriterSettings()
+	w, err := newWriter(settings)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create event hub connection")
+		log.Fatal().Err(err).Str("destination", viper.GetString("write_destination")).Msg("Failed to create writer")
+	}
+	writeClient := newSwapWriter(w)
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+
+	var reader *adx.Reader
+	if adxConfig := getADXConfig(); adxConfig.Enabled() {
+		client, err := adx.NewClient(adxConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Azure Data Explorer client")
+		}
+		reader, err = adx.NewReader(client, getReadConfig())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Azure Data Explorer reader")
+		}
 	}
 
 	// Set GIN_MODE
@@ -85,11 +136,27 @@ func main() {
 
 	// Global handler
 	// An array of paths to exclude from logging is passed to the handler
-	router.Use(logHandler([]string{viper.GetString("telemetry_path")}), gin.Recovery())
+	router.Use(logHandler([]string{viper.GetString("telemetry_path"), healthyPath, readyPath}), gin.Recovery())
 
 	// Route handlers
-	router.POST(viper.GetString("write_path"), timeHandler("write"), writeHandler(writeHub))
+	handlers.load()
+	router.POST(viper.GetString("write_path"), timeHandler("write"), writeHandler(writeClient, handlers))
+	if path := viper.GetString("otlp_path"); path != "" {
+		router.POST(path, timeHandler("otlp"), otlpHandler(writeClient, handlers))
+	}
+	if path := viper.GetString("influx_path"); path != "" {
+		router.POST(path, timeHandler("influx"), influxHandler(writeClient, handlers))
+	}
+	if reader != nil {
+		router.POST(viper.GetString("read_path"), timeHandler("read"), readHandler(reader, handlers))
+	}
 	router.GET(viper.GetString("telemetry_path"), gin.WrapH(promhttp.Handler()))
+	router.GET(healthyPath, healthyHandler())
+	router.GET(readyPath, readyHandler())
+	if viper.GetBool("status_enabled") {
+		router.GET(statusAPIPath, statusHandler(writeClient))
+		router.GET(statusPagePath, statusPageHandler(writeClient))
+	}
 
 	// HTTP server
 	srv := &http.Server{
@@ -107,6 +174,14 @@ func main() {
 		}
 	}()
 
+	// Reload the configuration on SIGHUP and file changes
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	go newReloader(writeClient, settings).run(reloadCtx, viper.GetBool("config_watch"))
+
+	// Check the writer connection for the readiness endpoint
+	configureHealth()
+	go health.monitor(reloadCtx, writeClient)
+
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout context.
 	quit := make(chan os.Signal, 1)
@@ -121,6 +196,8 @@ func main() {
 	<-quit
 
 	log.Info().Msg("received shutdown signal")
+	health.shutdown.Store(true)
+	stopReload()
 
 	ctx, cancel := context.WithTimeout(context.Background(), (viper.GetDuration("write_timeout") + viper.GetDuration("read_timeout")))
 	defer cancel()
@@ -130,21 +207,51 @@ func main() {
 		log.Error().Err(err).Msg("server shutdown error")
 	}
 
-	// Close event hub client
-	if err := writeHub.Close(ctx); err != nil {
-		log.Error().Err(err).Msg("event hub close error")
+	// Close writer
+	if err := writeClient.Close(ctx); err != nil {
+		log.Error().Err(err).Msg("writer close error")
 	}
 
 	log.Info().Str("version", Version).Str("commit", Commit).Str("build", Build).Msgf("%s exiting", AppName)
 }
 
 type writer interface {
-	Write(ctx context.Context, samples model.Samples) error
+	Write(ctx context.Context, samples model.Samples) (remote.Result, error)
 	Name() string
 	Close(ctx context.Context) error
+}
+
+// resetter is implemented by writers which reconnect after send failures
+type resetter interface {
 	ResetConfig(*hub.EventHubConfig) error
 }
 
+// newWriter creates the writer of a destination from its settings
+func newWriter(settings *writerSettings) (writer, error) {
+	switch settings.Destination {
+	case eventHubDestination:
+		client, err := hub.NewClient(settings.Hub)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case kafkaDestination:
+		client, err := kafka.NewWriter(settings.Kafka)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case adxDestination:
+		client, err := adx.NewWriter(settings.ADX, settings.Ingest)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("unknown write destination '%s'", settings.Destination)
+	}
+}
+
 // logHandler initializes a gin logging middleware.
 //
 // Used by the global router.Use() to generate a combined HTTP access and error log.
@@ -225,21 +332,15 @@ func timeHandler(path string) gin.HandlerFunc {
 }
 
 // writeHandler send to Event Hubs
-func writeHandler(w writer) func(c *gin.Context) {
+func writeHandler(w writer, settings *handlerSettings) func(c *gin.Context) {
 	return func(c *gin.Context) {
+		limits := settings.limits.Load()
 		httpRequestsTotal.Add(float64(1))
 
-		compressed, err := ioutil.ReadAll(c.Request.Body)
+		// Prometheus remote write bodies are snappy compressed
+		reqBuf, err := limits.readBody(c, "snappy")
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			log.ErrorObj(err).Msg("read request body failed")
-			return
-		}
-
-		reqBuf, err := snappy.Decode(nil, compressed)
-		if err != nil {
-			c.AbortWithStatus(http.StatusBadRequest)
-			log.ErrorObj(err).Msg("decompress request body failed")
+			abortRequest(c, err)
 			return
 		}
 
@@ -250,14 +351,26 @@ func writeHandler(w writer) func(c *gin.Context) {
 			return
 		}
 
+		if err := limits.checkWriteRequest(&req); err != nil {
+			abortRequest(c, err)
+			return
+		}
+
 		samples := protoToSamples(&req)
 		receivedSamples.Add(float64(len(samples)))
 
 		ctx, cancel := context.WithCancel(c)
 		defer cancel()
-		if err := sendSamples(ctx, w, samples); err != nil {
+		result, err := sendSamples(ctx, w, samples)
+		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
-			log.ErrorObj(err).Int("num_samples", len(samples)).Msg("Error sending samples to remote storage")
+			log.ErrorObj(err).Int("num_samples", len(samples)).Int("sent", result.Sent).Int("send_failed", result.SendFailed).Msg("Error sending samples to remote storage")
+			return
+		}
+		if result.SerializeFailed > 0 {
+			// Retrying will not help, report the loss without a retry
+			c.AbortWithStatus(http.StatusBadRequest)
+			log.Warn().Int("num_samples", len(samples)).Int("serialize_failed", result.SerializeFailed).Msg("Samples could not be serialized")
 			return
 		}
 	}
@@ -279,16 +392,10 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 		}
 
 		for _, s := range ts.Samples {
-			// Convert sample value float64:NaN to a default value
-			tempValue := s.Value
-			if math.IsNaN(tempValue) {
-				log.Debug().Float64("default-value", defaultNaNValue).Msg("Sample value NaN not supported, setting default")
-				tempValue = defaultNaNValue
-			}
-
+			// NaN values, including staleness markers, are handled by the serializer value policy
 			samples = append(samples, &model.Sample{
 				Metric:    metric,
-				Value:     model.SampleValue(tempValue),
+				Value:     model.SampleValue(s.Value),
 				Timestamp: model.Time(s.Timestamp),
 			})
 		}
@@ -297,22 +404,54 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 	return samples
 }
 
-func sendSamples(ctx context.Context, w writer, samples model.Samples) error {
+// sendSamples writes samples and updates the sample counters from the result
+func sendSamples(ctx context.Context, w writer, samples model.Samples) (remote.Result, error) {
+	health.writes.Add(1)
+	defer health.writes.Add(-1)
+
 	begin := time.Now()
 
-	err := w.Write(ctx, samples)
+	result, err := w.Write(ctx, samples)
 
 	duration := time.Since(begin).Seconds()
+
+	sentSamples.WithLabelValues(w.Name()).Add(float64(result.Sent))
+	failedSamples.WithLabelValues(w.Name()).Add(float64(result.SendFailed))
+	serializeFailedSamples.WithLabelValues(w.Name()).Add(float64(result.SerializeFailed))
+	droppedSamples.WithLabelValues(w.Name()).Add(float64(result.Dropped))
+	eventBytes.WithLabelValues(w.Name()).Add(float64(result.Bytes))
+	eventCompressedBytes.WithLabelValues(w.Name()).Add(float64(result.CompressedBytes))
+	sends.record(w.Name(), result, err)
+
+	if result.Sent > 0 {
+		health.connected()
+	}
 	if err != nil {
-		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
+		if connectionFailed(ctx, result) {
+			health.failed(err)
+		}
+
 		// EventHub may have changed its ip address
 		// reset the configuration to trigger a new dns resolution
-		w.ResetConfig(getWriterConfig())
-		return err
+		if r, ok := w.(resetter); ok {
+			configMu.RLock()
+			cfg := getWriterConfig()
+			configMu.RUnlock()
+			r.ResetConfig(cfg)
+		}
+		return result, err
 	}
 
-	sentSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
 	sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
 
-	return nil
+	return result, nil
+}
+
+// connectionFailed reports whether a failed write shows a problem with the destination connection
+//
+// Only writes where every sample sent failed count. Single rejected events and
+// requests cancelled by the client are left to the metrics, they don't make
+// the adapter unready.
+func connectionFailed(ctx context.Context, result remote.Result) bool {
+	return ctx.Err() == nil && result.Sent == 0 && result.SendFailed > 0
 }
@@ -40,6 +40,12 @@ var (
 			Help: "Count of all http requests",
 		},
 	)
+	readRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_read_requests_total",
+			Help: "Count of remote read requests.",
+		},
+	)
 	receivedSamples = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "adapter_samples_received_total",
@@ -60,6 +66,41 @@ var (
 		},
 		[]string{"remote"},
 	)
+	serializeFailedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_samples_serialize_failed_total",
+			Help: "Total number of processed samples which could not be serialized.",
+		},
+		[]string{"remote"},
+	)
+	droppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_samples_dropped_total",
+			Help: "Total number of processed samples which were intentionally not sent to remote storage.",
+		},
+		[]string{"remote"},
+	)
+	eventBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_event_bytes_total",
+			Help: "Total size of serialized events before compression.",
+		},
+		[]string{"remote"},
+	)
+	eventCompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_event_compressed_bytes_total",
+			Help: "Total size of serialized events after compression.",
+		},
+		[]string{"remote"},
+	)
+	rejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_requests_rejected_total",
+			Help: "Total number of write requests rejected for exceeding a request limit.",
+		},
+		[]string{"reason"},
+	)
 	sentBatchDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "adapter_batch_send_duration_seconds",
@@ -68,6 +109,25 @@ var (
 		},
 		[]string{"remote"},
 	)
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_config_reloads_total",
+			Help: "Total number of configuration reloads.",
+		},
+		[]string{"result"},
+	)
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "adapter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configReloadTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "adapter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
 	httpRequestDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_ms",
@@ -81,9 +141,18 @@ var (
 func init() {
 	prometheus.MustRegister(adapterInfo)
 	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(readRequestsTotal)
 	prometheus.MustRegister(receivedSamples)
 	prometheus.MustRegister(sentSamples)
 	prometheus.MustRegister(failedSamples)
+	prometheus.MustRegister(serializeFailedSamples)
+	prometheus.MustRegister(droppedSamples)
+	prometheus.MustRegister(eventBytes)
+	prometheus.MustRegister(eventCompressedBytes)
+	prometheus.MustRegister(rejectedRequests)
 	prometheus.MustRegister(sentBatchDuration)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadTime)
 	prometheus.MustRegister(httpRequestDuration)
 }
@@ -0,0 +1,142 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/otlp"
+)
+
+// OTLP/HTTP content types
+const (
+	otlpProtobufContentType = "application/x-protobuf"
+	otlpJSONContentType     = "application/json"
+)
+
+// otlpHandler receives OTLP/HTTP metrics export requests and sends them to Event Hubs
+//
+// An ExportMetricsServiceRequest has the same encoding as MetricsData, which
+// avoids depending on the gRPC service definitions.
+func otlpHandler(w writer, settings *handlerSettings) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		limits, opts := settings.limits.Load(), settings.otlp.Load()
+		httpRequestsTotal.Add(float64(1))
+
+		contentType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || (contentType != otlpProtobufContentType && contentType != otlpJSONContentType) {
+			c.AbortWithStatus(http.StatusUnsupportedMediaType)
+			log.Error().Str("content_type", c.GetHeader("Content-Type")).Msg("unsupported OTLP content type")
+			return
+		}
+
+		// OTLP/HTTP bodies are uncompressed unless a Content-Encoding is set
+		reqBuf, err := limits.readBody(c, "identity")
+		if err != nil {
+			abortRequest(c, err)
+			return
+		}
+
+		var req metricspb.MetricsData
+		if contentType == otlpJSONContentType {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(reqBuf, &req)
+		} else {
+			err = proto.Unmarshal(reqBuf, &req)
+		}
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			log.ErrorObj(err).Msg("unmarshal OTLP request body failed")
+			return
+		}
+
+		samples, rejected := otlp.Convert(&req, opts)
+		if err := limits.checkCounts(seriesCount(samples), len(samples)); err != nil {
+			abortRequest(c, err)
+			return
+		}
+		receivedSamples.Add(float64(len(samples)))
+
+		ctx, cancel := context.WithCancel(c)
+		defer cancel()
+		result, err := sendSamples(ctx, w, samples)
+		if err != nil {
+			// OTLP exporters only retry 429, 502, 503 and 504
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			log.ErrorObj(err).Int("num_samples", len(samples)).Int("sent", result.Sent).Int("send_failed", result.SendFailed).Msg("Error sending samples to remote storage")
+			return
+		}
+
+		var message string
+		if rejected > 0 {
+			message = fmt.Sprintf("unsupported delta or exponential histogram data points: %d", rejected)
+			log.Debug().Int("rejected", rejected).Msg("OTLP data points not converted")
+		}
+		if result.SerializeFailed > 0 {
+			log.Warn().Int("num_samples", len(samples)).Int("serialize_failed", result.SerializeFailed).Msg("Samples could not be serialized")
+			message = fmt.Sprintf("%d samples could not be serialized", result.SerializeFailed)
+			rejected += result.SerializeFailed
+		}
+
+		c.Data(http.StatusOK, contentType, otlpResponse(contentType == otlpJSONContentType, rejected, message))
+	}
+}
+
+// otlpResponse encodes an ExportMetricsServiceResponse
+//
+// The partial success is only set when data points were rejected.
+func otlpResponse(asJSON bool, rejected int, message string) []byte {
+	if asJSON {
+		resp := map[string]interface{}{}
+		if rejected > 0 {
+			resp["partialSuccess"] = map[string]string{
+				// int64 fields are strings in the protobuf JSON mapping
+				"rejectedDataPoints": strconv.Itoa(rejected),
+				"errorMessage":       message,
+			}
+		}
+		buf, _ := json.Marshal(resp)
+		return buf
+	}
+
+	if rejected == 0 {
+		return []byte{}
+	}
+
+	// ExportMetricsPartialSuccess { int64 rejected_data_points = 1; string error_message = 2; }
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+
+	// ExportMetricsServiceResponse { ExportMetricsPartialSuccess partial_success = 1; }
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, partial)
+}
@@ -0,0 +1,205 @@
+package otlp
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"strings"
+	"unicode"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// unitMap translates UCUM units to their Prometheus name.
+var unitMap = map[string]string{
+	// Time
+	"d":   "days",
+	"h":   "hours",
+	"min": "minutes",
+	"s":   "seconds",
+	"ms":  "milliseconds",
+	"us":  "microseconds",
+	"ns":  "nanoseconds",
+
+	// Bytes
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+
+	// SI
+	"m":   "meters",
+	"V":   "volts",
+	"A":   "amperes",
+	"J":   "joules",
+	"W":   "watts",
+	"g":   "grams",
+	"Cel": "celsius",
+	"Hz":  "hertz",
+	"%":   "percent",
+	"1":   "",
+}
+
+// perUnitMap translates the denominator of UCUM rate units to their Prometheus name.
+var perUnitMap = map[string]string{
+	"s":  "second",
+	"m":  "minute",
+	"h":  "hour",
+	"d":  "day",
+	"w":  "week",
+	"mo": "month",
+	"y":  "year",
+}
+
+// MetricName returns the Prometheus metric name of an OpenTelemetry metric
+//
+// Follows the OpenTelemetry to Prometheus naming rules: invalid characters are
+// replaced, the unit is appended as a suffix, monotonic sums get a "_total"
+// suffix and gauges with unit "1" get a "_ratio" suffix. Without suffixes only
+// the invalid characters are replaced.
+func MetricName(metric *metricspb.Metric, addSuffixes bool) string {
+	if !addSuffixes {
+		return sanitizeMetricName(metric.GetName())
+	}
+
+	tokens := strings.FieldsFunc(metric.GetName(), notAlphanumeric)
+
+	mainUnit, perUnit := unitSuffixes(metric.GetUnit())
+	if mainUnit != "" && !contains(tokens, mainUnit) {
+		tokens = append(tokens, mainUnit)
+	}
+	if perUnit != "" && !contains(tokens, perUnit) {
+		tokens = append(tokens, "per", perUnit)
+	}
+
+	if sum := metric.GetSum(); sum != nil && sum.GetIsMonotonic() {
+		tokens = append(remove(tokens, "total"), "total")
+	}
+	if metric.GetUnit() == "1" && metric.GetGauge() != nil {
+		tokens = append(remove(tokens, "ratio"), "ratio")
+	}
+
+	name := strings.Join(tokens, "_")
+	if name != "" && unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
+
+// LabelName returns the Prometheus label name of an OpenTelemetry attribute key
+func LabelName(key string) string {
+	if key == "" {
+		return key
+	}
+
+	label := strings.Map(func(r rune) rune {
+		if notAlphanumeric(r) {
+			return '_'
+		}
+		return r
+	}, key)
+
+	if unicode.IsDigit(rune(label[0])) {
+		label = "key_" + label
+	} else if strings.HasPrefix(label, "_") && !strings.HasPrefix(label, "__") {
+		label = "key" + label
+	}
+	return label
+}
+
+// unitSuffixes returns the name suffixes of a UCUM unit, ex. "By/s" returns "bytes", "second".
+func unitSuffixes(unit string) (string, string) {
+	// Remove annotations, ex. "{requests}/s"
+	unit = strings.TrimSpace(stripAnnotations(unit))
+
+	main, per, _ := strings.Cut(unit, "/")
+	main = strings.TrimSpace(main)
+	per = strings.TrimSpace(per)
+
+	if name, ok := unitMap[main]; ok {
+		main = name
+	}
+	if name, ok := perUnitMap[per]; ok {
+		per = name
+	}
+	return sanitizeUnit(main), sanitizeUnit(per)
+}
+
+// stripAnnotations removes curly brace annotations from a unit.
+func stripAnnotations(unit string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range unit {
+		switch {
+		case r == '{':
+			depth++
+		case r == '}' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// sanitizeUnit joins the alphanumeric runs of a unit with underscores.
+func sanitizeUnit(unit string) string {
+	return strings.Join(strings.FieldsFunc(unit, notAlphanumeric), "_")
+}
+
+// sanitizeMetricName replaces characters which are invalid in a Prometheus metric name.
+func sanitizeMetricName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if notAlphanumeric(r) && r != '_' && r != ':' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if name != "" && unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
+
+// notAlphanumeric reports whether a rune is not an ASCII letter or digit.
+func notAlphanumeric(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+}
+
+func contains(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(tokens []string, token string) []string {
+	out := tokens[:0]
+	for _, t := range tokens {
+		if t != token {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package otlp
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"testing"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+func TestMetricName(t *testing.T) {
+	gauge := &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+	counter := &metricspb.Metric_Sum{Sum: &metricspb.Sum{IsMonotonic: true}}
+	upDown := &metricspb.Metric_Sum{Sum: &metricspb.Sum{}}
+
+	tests := []struct {
+		metric   *metricspb.Metric
+		suffixes bool
+		want     string
+	}{
+		{metric: &metricspb.Metric{Name: "http.server.duration", Unit: "ms", Data: gauge}, suffixes: true, want: "http_server_duration_milliseconds"},
+		{metric: &metricspb.Metric{Name: "http.server.duration", Unit: "ms", Data: gauge}, want: "http_server_duration"},
+		{metric: &metricspb.Metric{Name: "network.io", Unit: "By/s", Data: gauge}, suffixes: true, want: "network_io_bytes_per_second"},
+		// The unit is not repeated
+		{metric: &metricspb.Metric{Name: "memory_bytes", Unit: "By", Data: gauge}, suffixes: true, want: "memory_bytes"},
+		{metric: &metricspb.Metric{Name: "requests", Unit: "{request}", Data: counter}, suffixes: true, want: "requests_total"},
+		// "total" is moved to the end
+		{metric: &metricspb.Metric{Name: "total.bytes", Unit: "By", Data: counter}, suffixes: true, want: "bytes_total"},
+		{metric: &metricspb.Metric{Name: "connections", Unit: "{connection}", Data: upDown}, suffixes: true, want: "connections"},
+		{metric: &metricspb.Metric{Name: "cpu.utilization", Unit: "1", Data: gauge}, suffixes: true, want: "cpu_utilization_ratio"},
+		{metric: &metricspb.Metric{Name: "cpu.utilization", Unit: "1", Data: counter}, suffixes: true, want: "cpu_utilization_total"},
+		{metric: &metricspb.Metric{Name: "2xx.responses", Data: gauge}, suffixes: true, want: "_2xx_responses"},
+		{metric: &metricspb.Metric{Name: "2xx.responses:rate", Data: gauge}, want: "_2xx_responses:rate"},
+	}
+	for _, tt := range tests {
+		if got := MetricName(tt.metric, tt.suffixes); got != tt.want {
+			t.Errorf("MetricName(%q, %q, %v) = %q, want %q", tt.metric.GetName(), tt.metric.GetUnit(), tt.suffixes, got, tt.want)
+		}
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "http.method", want: "http_method"},
+		{key: "k8s-pod", want: "k8s_pod"},
+		{key: "2fa", want: "key_2fa"},
+		{key: "_private", want: "key_private"},
+		// Reserved label names are kept
+		{key: "__name__", want: "__name__"},
+		{key: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := LabelName(tt.key); got != tt.want {
+			t.Errorf("LabelName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Package otlp converts OpenTelemetry (OTLP) metrics into Prometheus samples.
+package otlp
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// Resource attributes mapped to the Prometheus target labels
+const (
+	serviceNameAttribute       = "service.name"
+	serviceNamespaceAttribute  = "service.namespace"
+	serviceInstanceIDAttribute = "service.instance.id"
+)
+
+// Options for converting OpenTelemetry metrics
+type Options struct {
+	// AddSuffixes appends the unit and type suffixes to metric names.
+	AddSuffixes bool
+	// ResourceLabels are resource attributes copied to every sample as labels.
+	ResourceLabels []string
+}
+
+// Convert converts OTLP metrics into Prometheus samples
+//
+// Each histogram and summary data point becomes several samples. Delta sums
+// and histograms, and exponential histograms, have no Prometheus equivalent
+// and are not converted. returns the samples and the number of data points
+// which were not converted.
+func Convert(md *metricspb.MetricsData, opts *Options) (model.Samples, int) {
+	c := &converter{opts: opts}
+
+	for _, rm := range md.GetResourceMetrics() {
+		resource := resourceLabels(rm.GetResource().GetAttributes(), opts.ResourceLabels)
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, metric := range sm.GetMetrics() {
+				c.convertMetric(metric, resource)
+			}
+		}
+	}
+
+	return c.samples, c.dropped
+}
+
+// converter accumulates the samples of a single request.
+type converter struct {
+	opts    *Options
+	samples model.Samples
+	dropped int
+}
+
+// convertMetric appends the samples of every data point of a metric
+func (c *converter) convertMetric(metric *metricspb.Metric, resource model.Metric) {
+	name := MetricName(metric, c.opts.AddSuffixes)
+
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			c.addNumber(name, dp, resource)
+		}
+	case *metricspb.Metric_Sum:
+		if data.Sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+			c.dropped += len(data.Sum.GetDataPoints())
+			return
+		}
+		for _, dp := range data.Sum.GetDataPoints() {
+			c.addNumber(name, dp, resource)
+		}
+	case *metricspb.Metric_Histogram:
+		if data.Histogram.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+			c.dropped += len(data.Histogram.GetDataPoints())
+			return
+		}
+		for _, dp := range data.Histogram.GetDataPoints() {
+			c.addHistogram(name, dp, resource)
+		}
+	case *metricspb.Metric_Summary:
+		for _, dp := range data.Summary.GetDataPoints() {
+			c.addSummary(name, dp, resource)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		c.dropped += len(data.ExponentialHistogram.GetDataPoints())
+	}
+}
+
+// addNumber appends the sample of a gauge or sum data point
+func (c *converter) addNumber(name string, dp *metricspb.NumberDataPoint, resource model.Metric) {
+	var v float64
+	switch n := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		v = n.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		v = float64(n.AsInt)
+	}
+
+	c.add(pointLabels(name, dp.GetAttributes(), resource), v, dp.GetTimeUnixNano(), dp.GetFlags())
+}
+
+// addHistogram appends the "_bucket", "_sum" and "_count" samples of a histogram data point
+func (c *converter) addHistogram(name string, dp *metricspb.HistogramDataPoint, resource model.Metric) {
+	ts, flags := dp.GetTimeUnixNano(), dp.GetFlags()
+
+	if dp.Sum != nil {
+		c.add(pointLabels(name+"_sum", dp.GetAttributes(), resource), dp.GetSum(), ts, flags)
+	}
+	c.add(pointLabels(name+"_count", dp.GetAttributes(), resource), float64(dp.GetCount()), ts, flags)
+
+	// Prometheus buckets are cumulative
+	var cumulative uint64
+	counts := dp.GetBucketCounts()
+	for i, bound := range dp.GetExplicitBounds() {
+		if i < len(counts) {
+			cumulative += counts[i]
+		}
+		labels := pointLabels(name+"_bucket", dp.GetAttributes(), resource)
+		labels[model.BucketLabel] = model.LabelValue(formatFloat(bound))
+		c.add(labels, float64(cumulative), ts, flags)
+	}
+
+	labels := pointLabels(name+"_bucket", dp.GetAttributes(), resource)
+	labels[model.BucketLabel] = "+Inf"
+	c.add(labels, float64(dp.GetCount()), ts, flags)
+}
+
+// addSummary appends the quantile, "_sum" and "_count" samples of a summary data point
+func (c *converter) addSummary(name string, dp *metricspb.SummaryDataPoint, resource model.Metric) {
+	ts, flags := dp.GetTimeUnixNano(), dp.GetFlags()
+
+	c.add(pointLabels(name+"_sum", dp.GetAttributes(), resource), dp.GetSum(), ts, flags)
+	c.add(pointLabels(name+"_count", dp.GetAttributes(), resource), float64(dp.GetCount()), ts, flags)
+
+	for _, q := range dp.GetQuantileValues() {
+		labels := pointLabels(name, dp.GetAttributes(), resource)
+		labels[model.QuantileLabel] = model.LabelValue(formatFloat(q.GetQuantile()))
+		c.add(labels, q.GetValue(), ts, flags)
+	}
+}
+
+// add appends a sample, marking data points without a recorded value as stale
+func (c *converter) add(labels model.Metric, v float64, ts uint64, flags uint32) {
+	if flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+		v = math.Float64frombits(value.StaleNaN)
+	}
+
+	c.samples = append(c.samples, &model.Sample{
+		Metric:    labels,
+		Value:     model.SampleValue(v),
+		Timestamp: model.TimeFromUnixNano(int64(ts)),
+	})
+}
+
+// pointLabels returns the label set of a data point
+//
+// Resource labels take precedence over data point attributes, and the metric
+// name over both.
+func pointLabels(name string, attributes []*commonpb.KeyValue, resource model.Metric) model.Metric {
+	labels := make(model.Metric, len(attributes)+len(resource)+2)
+	addAttributes(labels, attributes)
+	for label, value := range resource {
+		labels[label] = value
+	}
+	labels[model.MetricNameLabel] = model.LabelValue(name)
+	return labels
+}
+
+// resourceLabels returns the labels every sample of a resource is given
+//
+// "job" and "instance" are set from the service attributes.
+func resourceLabels(attributes []*commonpb.KeyValue, promote []string) model.Metric {
+	labels := make(model.Metric, len(promote)+2)
+
+	var name, namespace string
+	for _, kv := range attributes {
+		switch kv.GetKey() {
+		case serviceNameAttribute:
+			name = attributeValue(kv.GetValue())
+		case serviceNamespaceAttribute:
+			namespace = attributeValue(kv.GetValue())
+		case serviceInstanceIDAttribute:
+			labels[model.InstanceLabel] = model.LabelValue(attributeValue(kv.GetValue()))
+		}
+
+		for _, key := range promote {
+			if kv.GetKey() == key {
+				labels[model.LabelName(LabelName(key))] = model.LabelValue(attributeValue(kv.GetValue()))
+			}
+		}
+	}
+
+	if name != "" {
+		if namespace != "" {
+			name = namespace + "/" + name
+		}
+		labels[model.JobLabel] = model.LabelValue(name)
+	}
+	return labels
+}
+
+// addAttributes adds attributes as labels
+//
+// Values of attributes sanitized to the same label name are joined with ";".
+func addAttributes(labels model.Metric, attributes []*commonpb.KeyValue) {
+	for _, kv := range attributes {
+		label := model.LabelName(LabelName(kv.GetKey()))
+		if label == "" {
+			continue
+		}
+
+		v := attributeValue(kv.GetValue())
+		if existing, ok := labels[label]; ok {
+			v = string(existing) + ";" + v
+		}
+		labels[label] = model.LabelValue(v)
+	}
+}
+
+// attributeValue returns the string form of an attribute value
+//
+// Arrays and maps are encoded as JSON, bytes as base64.
+func attributeValue(v *commonpb.AnyValue) string {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.GetStringValue()
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.GetBoolValue())
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.GetIntValue(), 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return formatFloat(v.GetDoubleValue())
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.GetBytesValue())
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue:
+		buf, err := json.Marshal(nativeValue(v))
+		if err != nil {
+			return ""
+		}
+		return string(buf)
+	default:
+		return ""
+	}
+}
+
+// nativeValue converts an attribute value into a value encoding/json can marshal
+func nativeValue(v *commonpb.AnyValue) interface{} {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.GetStringValue()
+	case *commonpb.AnyValue_BoolValue:
+		return v.GetBoolValue()
+	case *commonpb.AnyValue_IntValue:
+		return v.GetIntValue()
+	case *commonpb.AnyValue_DoubleValue:
+		d := v.GetDoubleValue()
+		if math.IsNaN(d) || math.IsInf(d, 0) {
+			return formatFloat(d)
+		}
+		return d
+	case *commonpb.AnyValue_BytesValue:
+		return v.GetBytesValue()
+	case *commonpb.AnyValue_ArrayValue:
+		values := v.GetArrayValue().GetValues()
+		arr := make([]interface{}, 0, len(values))
+		for _, item := range values {
+			arr = append(arr, nativeValue(item))
+		}
+		return arr
+	case *commonpb.AnyValue_KvlistValue:
+		values := v.GetKvlistValue().GetValues()
+		m := make(map[string]interface{}, len(values))
+		for _, kv := range values {
+			m[kv.GetKey()] = nativeValue(kv.GetValue())
+		}
+		return m
+	default:
+		return nil
+	}
+}
+
+// formatFloat formats a float the way Prometheus formats "le" and "quantile" label values.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
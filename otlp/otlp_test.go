@@ -0,0 +1,194 @@
+package otlp
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// Fixture data point time, 2023-11-14T22:13:20Z
+const (
+	pointTime  uint64     = 1700000000 * 1e9
+	sampleTime model.Time = 1700000000 * 1e3
+)
+
+var (
+	cumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	delta      = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+)
+
+func stringAttribute(key, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+// metricsData wraps metrics in a resource of service "api" instance "host-1"
+func metricsData(metrics ...*metricspb.Metric) *metricspb.MetricsData {
+	return &metricspb.MetricsData{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", "api"),
+			stringAttribute("service.namespace", "shop"),
+			stringAttribute("service.instance.id", "host-1"),
+			stringAttribute("cloud.region", "westus"),
+		}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}}
+}
+
+func numberPoint(v float64, attributes ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{Attributes: attributes, TimeUnixNano: pointTime, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: v}}
+}
+
+// sample returns the expected sample of a fixture, with the resource labels
+func sample(v float64, labels ...string) *model.Sample {
+	metric := model.Metric{"job": "shop/api", "instance": "host-1"}
+	for i := 0; i < len(labels); i += 2 {
+		metric[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+	}
+	return &model.Sample{Metric: metric, Value: model.SampleValue(v), Timestamp: sampleTime}
+}
+
+func TestConvert(t *testing.T) {
+	sumValue := 12.5
+	tests := []struct {
+		name    string
+		metric  *metricspb.Metric
+		opts    Options
+		want    model.Samples
+		dropped int
+	}{
+		{
+			name: "gauge",
+			metric: &metricspb.Metric{Name: "queue.depth", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+				numberPoint(3, stringAttribute("queue", "orders")),
+				{TimeUnixNano: pointTime, Value: &metricspb.NumberDataPoint_AsInt{AsInt: 7}},
+			}}}},
+			want: model.Samples{
+				sample(3, "__name__", "queue_depth", "queue", "orders"),
+				sample(7, "__name__", "queue_depth"),
+			},
+		},
+		{
+			name: "cumulative sum",
+			metric: &metricspb.Metric{Name: "http.server.requests", Unit: "{request}", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: cumulative,
+				IsMonotonic:            true,
+				DataPoints:             []*metricspb.NumberDataPoint{numberPoint(42, stringAttribute("http.method", "GET"))},
+			}}},
+			opts: Options{AddSuffixes: true},
+			want: model.Samples{sample(42, "__name__", "http_server_requests_total", "http_method", "GET")},
+		},
+		{
+			name: "histogram",
+			metric: &metricspb.Metric{Name: "rpc.duration", Unit: "s", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: cumulative,
+				DataPoints: []*metricspb.HistogramDataPoint{{
+					TimeUnixNano:   pointTime,
+					Count:          6,
+					Sum:            &sumValue,
+					ExplicitBounds: []float64{0.1, 1},
+					BucketCounts:   []uint64{1, 3, 2},
+				}},
+			}}},
+			opts: Options{AddSuffixes: true},
+			want: model.Samples{
+				sample(12.5, "__name__", "rpc_duration_seconds_sum"),
+				sample(6, "__name__", "rpc_duration_seconds_count"),
+				// Buckets are made cumulative, the last one is "+Inf"
+				sample(1, "__name__", "rpc_duration_seconds_bucket", "le", "0.1"),
+				sample(4, "__name__", "rpc_duration_seconds_bucket", "le", "1"),
+				sample(6, "__name__", "rpc_duration_seconds_bucket", "le", "+Inf"),
+			},
+		},
+		{
+			name: "summary",
+			metric: &metricspb.Metric{Name: "gc.pause", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: []*metricspb.SummaryDataPoint{{
+				TimeUnixNano: pointTime,
+				Count:        10,
+				Sum:          2,
+				QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
+					{Quantile: 0.5, Value: 0.1},
+					{Quantile: 0.99, Value: 0.8},
+				},
+			}}}}},
+			want: model.Samples{
+				sample(2, "__name__", "gc_pause_sum"),
+				sample(10, "__name__", "gc_pause_count"),
+				sample(0.1, "__name__", "gc_pause", "quantile", "0.5"),
+				sample(0.8, "__name__", "gc_pause", "quantile", "0.99"),
+			},
+		},
+		{
+			name: "delta sum dropped",
+			metric: &metricspb.Metric{Name: "requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: delta,
+				DataPoints:             []*metricspb.NumberDataPoint{numberPoint(1), numberPoint(2)},
+			}}},
+			dropped: 2,
+		},
+		{
+			name: "delta histogram dropped",
+			metric: &metricspb.Metric{Name: "latency", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: delta,
+				DataPoints:             []*metricspb.HistogramDataPoint{{TimeUnixNano: pointTime, Count: 1}},
+			}}},
+			dropped: 1,
+		},
+		{
+			name: "exponential histogram dropped",
+			metric: &metricspb.Metric{Name: "latency", Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+				AggregationTemporality: cumulative,
+				DataPoints:             []*metricspb.ExponentialHistogramDataPoint{{TimeUnixNano: pointTime, Count: 1}, {TimeUnixNano: pointTime, Count: 2}},
+			}}},
+			dropped: 2,
+		},
+		{
+			name:   "resource labels",
+			metric: &metricspb.Metric{Name: "up", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{numberPoint(1)}}}},
+			opts:   Options{ResourceLabels: []string{"cloud.region"}},
+			want:   model.Samples{sample(1, "__name__", "up", "cloud_region", "westus")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := Convert(metricsData(tt.metric), &tt.opts)
+			if dropped != tt.dropped {
+				t.Errorf("dropped = %d, want %d", dropped, tt.dropped)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("samples\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertNoRecordedValue(t *testing.T) {
+	dp := numberPoint(5)
+	dp.Flags = uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)
+	metric := &metricspb.Metric{Name: "up", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{dp}}}}
+
+	got, _ := Convert(metricsData(metric), &Options{})
+	if len(got) != 1 || !value.IsStaleNaN(float64(got[0].Value)) {
+		t.Errorf("samples = %v, want a staleness marker", got)
+	}
+}
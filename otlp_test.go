@@ -0,0 +1,105 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpRequest has a gauge, a delta sum of two data points and an exponential histogram of one
+const otlpRequest = `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+	{"name":"up","gauge":{"dataPoints":[{"timeUnixNano":"1700000000000000000","asDouble":1}]}},
+	{"name":"requests","sum":{"aggregationTemporality":1,"dataPoints":[{"timeUnixNano":"1700000000000000000","asInt":"1"},{"timeUnixNano":"1700000000000000000","asInt":"2"}]}},
+	{"name":"latency","exponentialHistogram":{"aggregationTemporality":2,"dataPoints":[{"timeUnixNano":"1700000000000000000","count":"1"}]}}
+]}]}]}`
+
+func TestOTLPPartialSuccess(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "rejected data points",
+			body: otlpRequest,
+			want: `{"partialSuccess":{"errorMessage":"unsupported delta or exponential histogram data points: 3","rejectedDataPoints":"3"}}`,
+		},
+		{
+			// The partial success is omitted when every data point is converted
+			name: "all converted",
+			body: `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"up","gauge":{"dataPoints":[{"asDouble":1}]}}]}]}]}`,
+			want: `{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("Content-Type", otlpJSONContentType)
+			rec, w := serveRequest(requestLimits{}, otlpHandler, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if rec.Body.String() != tt.want {
+				t.Errorf("response = %s, want %s", rec.Body, tt.want)
+			}
+			if len(w.samples) != 1 {
+				t.Errorf("%d samples written, want 1", len(w.samples))
+			}
+		})
+	}
+}
+
+func TestOTLPPartialSuccessProtobuf(t *testing.T) {
+	var md metricspb.MetricsData
+	if err := protojson.Unmarshal([]byte(otlpRequest), &md); err != nil {
+		t.Fatal(err)
+	}
+	body, err := proto.Marshal(&md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(body))
+	req.Header.Set("Content-Type", otlpProtobufContentType)
+	rec, _ := serveRequest(requestLimits{}, otlpHandler, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// ExportMetricsServiceResponse.partial_success.rejected_data_points
+	resp := rec.Body.Bytes()
+	num, typ, n := protowire.ConsumeTag(resp)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("response field %d of type %d, want partial_success", num, typ)
+	}
+	partial, _ := protowire.ConsumeBytes(resp[n:])
+	num, typ, n = protowire.ConsumeTag(partial)
+	if num != 1 || typ != protowire.VarintType {
+		t.Fatalf("partial success field %d of type %d, want rejected_data_points", num, typ)
+	}
+	if rejected, _ := protowire.ConsumeVarint(partial[n:]); rejected != 3 {
+		t.Errorf("rejected_data_points = %d, want 3", rejected)
+	}
+}
@@ -0,0 +1,177 @@
+// Package payload encodes Prometheus samples into event data and properties,
+// shared by the Event Hub and Kafka writers.
+package payload
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/registry"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+)
+
+const (
+	// ContentTypeProperty is the event property holding the MIME type of the event data.
+	ContentTypeProperty = "Content-Type"
+
+	// registryTimeout limits resolving the schema ID when the encoder is created.
+	registryTimeout = 20 * time.Second
+)
+
+// Config of the event data
+type Config struct {
+	Serializer serializers.SerializerConfig
+	// Registry attaches the schema ID of avro serializers when its URL is set.
+	Registry registry.Config
+	// CloudEvents wraps the data in a CloudEvents envelope when enabled.
+	CloudEvents cloudevents.Config
+	// Compression is the codec of the event data.
+	Compression string
+}
+
+// Encoder serializes, wraps and compresses samples
+type Encoder struct {
+	serializer  serializers.Serializer
+	envelope    *cloudevents.Envelope
+	compression compression.Codec
+	properties  map[string]interface{}
+}
+
+// New creates an encoder, resolving the schema ID when a registry is set
+func New(cfg *Config) (*Encoder, error) {
+	ser, err := serializers.NewSerializer(&cfg.Serializer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Registry.URL != "" {
+		ser, err = newRegistrySerializer(&cfg.Registry, ser)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var envelope *cloudevents.Envelope
+	if cfg.CloudEvents.Enabled() {
+		envelope, err = cloudevents.New(&cfg.CloudEvents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	codec, err := compression.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	// Properties added to every event
+	properties := map[string]interface{}{
+		ContentTypeProperty: ser.ContentType(),
+	}
+	if codec != compression.NoCompression {
+		properties[compression.ContentEncodingProperty] = codec.String()
+	}
+	if ep, ok := ser.(serializers.EventProperties); ok {
+		for name, value := range ep.EventProperties() {
+			properties[name] = value
+		}
+	}
+
+	return &Encoder{
+		serializer:  ser,
+		envelope:    envelope,
+		compression: codec,
+		properties:  properties,
+	}, nil
+}
+
+// newRegistrySerializer wraps a serializer to attach the schema registry ID of its schema
+func newRegistrySerializer(cfg *registry.Config, ser serializers.Serializer) (serializers.Serializer, error) {
+	client, err := registry.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	return registry.NewSerializer(ctx, client, ser)
+}
+
+// Encode serializes a sample into event data and adds the properties of the event to properties
+//
+// With an envelope, the Content-Type property is the content type of the
+// envelope and the CloudEvents attributes are added. Returns the data and its
+// size before compression.
+func (e *Encoder) Encode(sample *model.Sample, properties map[string]interface{}) ([]byte, int, error) {
+	data, err := e.serializer.Serialize(*sample)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for name, value := range e.properties {
+		properties[name] = value
+	}
+
+	if e.envelope != nil {
+		var (
+			contentType string
+			attributes  map[string]interface{}
+		)
+		data, contentType, attributes, err = e.envelope.Wrap(sample, data, e.serializer.ContentType())
+		if err != nil {
+			return nil, 0, err
+		}
+		properties[ContentTypeProperty] = contentType
+		for name, value := range attributes {
+			properties[name] = value
+		}
+	}
+
+	size := len(data)
+	data, err = e.compression.Compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, size, nil
+}
+
+// Properties returns the number of properties added to every event
+func (e *Encoder) Properties() int {
+	return len(e.properties)
+}
+
+// Enveloped reports whether the data is wrapped in a CloudEvents envelope.
+func (e *Encoder) Enveloped() bool {
+	return e.envelope != nil
+}
+
+// ADXFormat returns the Azure Data Explorer format of the event data
+//
+// Data compressed with a codec Azure Data Explorer can't decompress has no format.
+func (e *Encoder) ADXFormat() kusto.DataFormat {
+	if !e.compression.IsADX() {
+		return kusto.NoFormat
+	}
+	return e.serializer.ADXFormat()
+}
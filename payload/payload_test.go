@@ -0,0 +1,147 @@
+package payload
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+var testSample = &model.Sample{
+	Metric:    model.Metric{model.MetricNameLabel: "up", "job": "node"},
+	Value:     1,
+	Timestamp: 1700000000000,
+}
+
+func newTestEncoder(t *testing.T, cfg Config) *Encoder {
+	t.Helper()
+	cfg.Serializer = serializers.SerializerConfig{DataFormat: "json", Fields: record.DefaultFields()}
+	e, err := New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncode(t *testing.T) {
+	e := newTestEncoder(t, Config{})
+
+	properties := map[string]interface{}{"Table": "up"}
+	data, size, err := e.Encode(testSample, properties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(data) {
+		t.Errorf("size = %d, want the data size %d", size, len(data))
+	}
+	if !json.Valid(data) {
+		t.Errorf("data = %s, want json", data)
+	}
+
+	want := map[string]interface{}{"Table": "up", ContentTypeProperty: "application/json"}
+	if len(properties) != len(want) {
+		t.Errorf("properties = %v, want %v", properties, want)
+	}
+	for name, value := range want {
+		if properties[name] != value {
+			t.Errorf("property %s = %v, want %v", name, properties[name], value)
+		}
+	}
+	if e.Properties() != 1 || e.Enveloped() {
+		t.Errorf("Properties = %d, Enveloped = %v", e.Properties(), e.Enveloped())
+	}
+	if e.ADXFormat() != kusto.JSONFormat {
+		t.Errorf("ADXFormat = %v, want json", e.ADXFormat())
+	}
+}
+
+func TestEncodeCompression(t *testing.T) {
+	tests := []struct {
+		codec  string
+		format kusto.DataFormat
+	}{
+		{codec: "gzip", format: kusto.JSONFormat},
+		{codec: "snappy", format: kusto.NoFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			e := newTestEncoder(t, Config{Compression: tt.codec})
+
+			properties := map[string]interface{}{}
+			data, size, err := e.Encode(testSample, properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if json.Valid(data) || size == len(data) {
+				t.Errorf("data of %d bytes from %d is not compressed", len(data), size)
+			}
+			if properties[compression.ContentEncodingProperty] != tt.codec {
+				t.Errorf("%s = %v, want %s", compression.ContentEncodingProperty, properties[compression.ContentEncodingProperty], tt.codec)
+			}
+			// Data Azure Data Explorer can't decompress is not routed
+			if e.ADXFormat() != tt.format {
+				t.Errorf("ADXFormat = %v, want %v", e.ADXFormat(), tt.format)
+			}
+		})
+	}
+}
+
+func TestEncodeEnvelope(t *testing.T) {
+	tests := []struct {
+		mode        string
+		contentType string
+	}{
+		{mode: cloudevents.StructuredMode, contentType: cloudevents.ContentType},
+		{mode: cloudevents.BinaryMode, contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			e := newTestEncoder(t, Config{CloudEvents: cloudevents.Config{Mode: tt.mode, Source: "/adapter"}})
+			if !e.Enveloped() {
+				t.Fatal("Enveloped = false")
+			}
+
+			properties := map[string]interface{}{}
+			if _, _, err := e.Encode(testSample, properties); err != nil {
+				t.Fatal(err)
+			}
+			if properties[ContentTypeProperty] != tt.contentType {
+				t.Errorf("%s = %v, want %s", ContentTypeProperty, properties[ContentTypeProperty], tt.contentType)
+			}
+			if tt.mode == cloudevents.BinaryMode && properties["cloudEvents:source"] != "/adapter" {
+				t.Errorf("properties = %v, want the CloudEvents attributes", properties)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(&Config{Serializer: serializers.SerializerConfig{DataFormat: "xml", Fields: record.DefaultFields()}}); err == nil {
+		t.Error("unknown serializer accepted")
+	}
+	if _, err := New(&Config{Serializer: serializers.SerializerConfig{DataFormat: "json", Fields: record.DefaultFields()}, Compression: "lz4"}); err == nil {
+		t.Error("unknown compression accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/adx"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+const (
+	// defaultReadMaxSamples is the default limit of samples returned by a read query.
+	defaultReadMaxSamples = 5000000
+	// maxFrameBytes limits the size of a streamed remote read frame, as the Prometheus default.
+	maxFrameBytes = 1 << 20
+)
+
+// readHandler answers Prometheus remote read requests from Azure Data Explorer
+func readHandler(r *adx.Reader, settings *handlerSettings) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		limits := settings.limits.Load()
+		readRequestsTotal.Inc()
+
+		// Prometheus remote read bodies are snappy compressed
+		reqBuf, err := limits.readBody(c, "snappy")
+		if err != nil {
+			abortRequest(c, err)
+			return
+		}
+
+		var req prompb.ReadRequest
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			log.ErrorObj(err).Msg("unmarshal read request body failed")
+			return
+		}
+
+		if responseType(&req) == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			streamRead(c, r, &req)
+			return
+		}
+
+		resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(req.Queries))}
+		for _, q := range req.Queries {
+			series, err := r.Read(c, q)
+			if err != nil {
+				abortRead(c, err)
+				return
+			}
+			resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: series})
+		}
+
+		buf, err := proto.Marshal(resp)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			log.ErrorObj(err).Msg("marshal read response failed")
+			return
+		}
+
+		c.Header("Content-Encoding", "snappy")
+		c.Data(http.StatusOK, "application/x-protobuf", snappy.Encode(nil, buf))
+	}
+}
+
+// abortRead responds to a query which failed before any response was sent
+//
+// Queries the adapter can't answer are rejected with HTTP 400.
+func abortRead(c *gin.Context, err error) {
+	if errors.Is(err, adx.ErrNameMatcher) {
+		log.Warn().Err(err).Msg("Unsupported read query")
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.AbortWithStatus(http.StatusBadRequest)
+		c.Writer.WriteString(err.Error())
+		return
+	}
+	log.ErrorObj(err).Msg("Error reading samples from Azure Data Explorer")
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// responseType returns the first accepted response type the adapter supports
+func responseType(req *prompb.ReadRequest) prompb.ReadRequest_ResponseType {
+	for _, t := range req.AcceptedResponseTypes {
+		if t == prompb.ReadRequest_SAMPLES || t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return t
+		}
+	}
+	return prompb.ReadRequest_SAMPLES
+}
+
+// streamRead writes a streamed XOR chunks response
+//
+// Series are batched into frames of up to maxFrameBytes. Errors after the
+// first frame can't change the response status, the stream is cut short.
+func streamRead(c *gin.Context, r *adx.Reader, req *prompb.ReadRequest) {
+	c.Header("Content-Type", remote.ChunkedReadContentType)
+
+	flusher, _ := c.Writer.(http.Flusher)
+	cw := remote.NewChunkedWriter(c.Writer, flusher)
+	started := false
+
+	fail := func(err error, msg string) {
+		log.ErrorObj(err).Bool("streaming", started).Msg(msg)
+		if !started {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+
+	for i, q := range req.Queries {
+		series, err := r.Read(c, q)
+		if err != nil && !started {
+			abortRead(c, err)
+			return
+		}
+		if err != nil {
+			fail(err, "Error reading samples from Azure Data Explorer")
+			return
+		}
+
+		frame := &prompb.ChunkedReadResponse{QueryIndex: int64(i)}
+		size := 0
+		for _, s := range series {
+			chunks, err := remote.EncodeChunks(s.Samples)
+			if err != nil {
+				fail(err, "encode chunks failed")
+				return
+			}
+
+			cs := &prompb.ChunkedSeries{Labels: s.Labels, Chunks: chunks}
+			if size > 0 && size+cs.Size() > maxFrameBytes {
+				if err := writeFrame(cw, frame); err != nil {
+					fail(err, "write read response frame failed")
+					return
+				}
+				started = true
+				frame = &prompb.ChunkedReadResponse{QueryIndex: int64(i)}
+				size = 0
+			}
+			frame.ChunkedSeries = append(frame.ChunkedSeries, cs)
+			size += cs.Size()
+		}
+
+		if len(frame.ChunkedSeries) > 0 {
+			if err := writeFrame(cw, frame); err != nil {
+				fail(err, "write read response frame failed")
+				return
+			}
+			started = true
+		}
+	}
+
+	if !started {
+		// No series matched, send the headers
+		c.Status(http.StatusOK)
+	}
+}
+
+// writeFrame marshals and writes a single streamed response frame
+func writeFrame(cw *remote.ChunkedWriter, frame *prompb.ChunkedReadResponse) error {
+	buf, err := proto.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	_, err = cw.Write(buf)
+	return err
+}
@@ -0,0 +1,245 @@
+// Package registry registers Avro schemas with a schema registry and attaches
+// the schema identity to serialized events.
+package registry
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/token"
+)
+
+const (
+	// ConfluentType is a Confluent compatible schema registry.
+	ConfluentType = "confluent"
+	// AzureType is an Azure Event Hubs schema registry.
+	AzureType = "azure"
+
+	// azureAPIVersion is the Azure Schema Registry REST API version.
+	azureAPIVersion = "2022-10"
+	// azureResource is the Azure Active Directory resource of the Azure Schema Registry.
+	azureResource = "https://eventhubs.azure.net"
+	// confluentContentType is the Confluent Schema Registry REST API content type.
+	confluentContentType = "application/vnd.schemaregistry.v1+json"
+)
+
+// Config for a schema registry
+type Config struct {
+	// URL of the registry, ex. "http://localhost:8081" or "https://foo.servicebus.windows.net".
+	URL string
+	// Type is the registry REST API, "confluent" or "azure".
+	Type string
+	// Subject is the Confluent subject or Azure schema name.
+	Subject string
+	// Group is the Azure schema group.
+	Group string
+	// Register registers the schema when true, otherwise looks up an existing schema.
+	Register bool
+	// Encoding attaches the schema ID as an event "property" or a payload "prefix".
+	Encoding string
+	// Username and Password for Confluent basic authentication.
+	Username string
+	Password string
+	// Token for Azure Active Directory authentication.
+	Token token.Config
+	// Timeout for registry requests.
+	Timeout time.Duration
+}
+
+// Client for a schema registry REST API
+type Client struct {
+	cfg   Config
+	http  *http.Client
+	token *token.Provider
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// NewClient creates a schema registry client
+func NewClient(cfg *Config) (*Client, error) {
+	if _, err := url.Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid schema registry url: %w", err)
+	}
+	if cfg.Subject == "" {
+		return nil, fmt.Errorf("schema registry subject must not be empty")
+	}
+
+	client := &Client{
+		cfg:   *cfg,
+		http:  &http.Client{Timeout: cfg.Timeout},
+		cache: make(map[string]string),
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case ConfluentType, "":
+		client.cfg.Type = ConfluentType
+	case AzureType:
+		if cfg.Group == "" {
+			return nil, fmt.Errorf("azure schema registry group must not be empty")
+		}
+		if cfg.Token.Enabled() {
+			provider, err := token.NewProvider(&cfg.Token, azureResource)
+			if err != nil {
+				return nil, err
+			}
+			client.token = provider
+		}
+		client.cfg.Type = AzureType
+	default:
+		return nil, fmt.Errorf("Unknown schema registry type: '%s'", strings.ToLower(cfg.Type))
+	}
+
+	return client, nil
+}
+
+// SchemaID returns the registry ID of an Avro schema
+//
+// IDs are cached, the registry is only called once for each schema.
+func (c *Client) SchemaID(ctx context.Context, schema string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.cache[schema]; ok {
+		return id, nil
+	}
+
+	var (
+		id  string
+		err error
+	)
+	if c.cfg.Type == AzureType {
+		id, err = c.azureSchemaID(ctx, schema)
+	} else {
+		id, err = c.confluentSchemaID(ctx, schema)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Info().Str("registry", c.cfg.URL).Str("subject", c.cfg.Subject).Str("schema_id", id).Msg("schema registry id resolved")
+	c.cache[schema] = id
+	return id, nil
+}
+
+// confluentSchemaID registers, or looks up, a schema using the Confluent REST API
+//
+// See [ https://docs.confluent.io/platform/current/schema-registry/develop/api.html ]
+func (c *Client) confluentSchemaID(ctx context.Context, schema string) (string, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := strings.TrimSuffix(c.cfg.URL, "/") + "/subjects/" + url.PathEscape(c.cfg.Subject)
+	if c.cfg.Register {
+		endpoint += "/versions"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", confluentContentType)
+	req.Header.Set("Accept", confluentContentType)
+	if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID *int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode schema registry response: %w", err)
+	}
+	if result.ID == nil {
+		return "", fmt.Errorf("schema registry response has no id")
+	}
+	return strconv.Itoa(*result.ID), nil
+}
+
+// azureSchemaID registers, or looks up, a schema using the Azure Schema Registry REST API
+//
+// See [ https://learn.microsoft.com/en-us/rest/api/schemaregistry/ ]
+func (c *Client) azureSchemaID(ctx context.Context, schema string) (string, error) {
+	endpoint := fmt.Sprintf("%s/$schemaGroups/%s/schemas/%s", strings.TrimSuffix(c.cfg.URL, "/"), url.PathEscape(c.cfg.Group), url.PathEscape(c.cfg.Subject))
+	method := http.MethodPut
+	if !c.cfg.Register {
+		endpoint += ":get-id"
+		method = http.MethodPost
+	}
+	endpoint += "?api-version=" + azureAPIVersion
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, strings.NewReader(schema))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; serialization=Avro")
+	if c.token != nil {
+		bearer, err := c.token.Token(ctx)
+		if err != nil {
+			return "", fmt.Errorf("schema registry token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	id := resp.Header.Get("Schema-Id")
+	if id == "" {
+		return "", fmt.Errorf("schema registry response has no Schema-Id header")
+	}
+	return id, nil
+}
+
+// do sends a request, returning an error for unsuccessful responses
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("schema registry %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
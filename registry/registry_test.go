@@ -0,0 +1,333 @@
+package registry
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/avrojson"
+)
+
+const testSchema = `{"type":"record","name":"sample","fields":[{"name":"value","type":"double"}]}`
+
+// request is a request received by the registry stand-in.
+type request struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+// registryStandIn records requests and answers them with respond
+type registryStandIn struct {
+	*httptest.Server
+	requests []request
+}
+
+func newRegistryStandIn(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) *registryStandIn {
+	t.Helper()
+	s := &registryStandIn{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.requests = append(s.requests, request{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: string(body)})
+		respond(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestClient(t *testing.T, cfg Config) *Client {
+	t.Helper()
+	cfg.Timeout = 5 * time.Second
+	client, err := NewClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestConfluentSchemaID(t *testing.T) {
+	tests := []struct {
+		name     string
+		register bool
+		path     string
+	}{
+		{name: "register", register: true, path: "/subjects/prometheus-value/versions"},
+		{name: "lookup", register: false, path: "/subjects/prometheus-value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRegistryStandIn(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", confluentContentType)
+				io.WriteString(w, `{"subject":"prometheus-value","version":1,"id":42}`)
+			})
+			client := newTestClient(t, Config{URL: s.URL + "/", Subject: "prometheus-value", Register: tt.register, Username: "user", Password: "secret"})
+
+			id, err := client.SchemaID(context.Background(), testSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != "42" {
+				t.Errorf("id = %q, want 42", id)
+			}
+
+			// Resolved IDs are cached
+			if _, err := client.SchemaID(context.Background(), testSchema); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.requests) != 1 {
+				t.Fatalf("registry received %d requests, want 1", len(s.requests))
+			}
+
+			req := s.requests[0]
+			if req.method != http.MethodPost || req.path != tt.path {
+				t.Errorf("request = %s %s, want POST %s", req.method, req.path, tt.path)
+			}
+			if got := req.header.Get("Content-Type"); got != confluentContentType {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if got := req.header.Get("Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+				t.Errorf("Authorization = %q, want basic authentication", got)
+			}
+			var body map[string]string
+			if err := json.Unmarshal([]byte(req.body), &body); err != nil || body["schema"] != testSchema {
+				t.Errorf("body = %s, want the schema", req.body)
+			}
+		})
+	}
+}
+
+func TestAzureSchemaID(t *testing.T) {
+	tests := []struct {
+		name     string
+		register bool
+		method   string
+		path     string
+	}{
+		{name: "register", register: true, method: http.MethodPut, path: "/$schemaGroups/metrics/schemas/prometheus"},
+		{name: "lookup", register: false, method: http.MethodPost, path: "/$schemaGroups/metrics/schemas/prometheus:get-id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRegistryStandIn(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Schema-Id", "0b3f9ac2a4d54d2fa2bd4a7c0c0d1e5f")
+				w.WriteHeader(http.StatusNoContent)
+			})
+			client := newTestClient(t, Config{URL: s.URL, Type: "Azure", Group: "metrics", Subject: "prometheus", Register: tt.register})
+
+			id, err := client.SchemaID(context.Background(), testSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != "0b3f9ac2a4d54d2fa2bd4a7c0c0d1e5f" {
+				t.Errorf("id = %q", id)
+			}
+
+			req := s.requests[0]
+			if req.method != tt.method || req.path != tt.path {
+				t.Errorf("request = %s %s, want %s %s", req.method, req.path, tt.method, tt.path)
+			}
+			if req.query != "api-version="+azureAPIVersion {
+				t.Errorf("query = %q", req.query)
+			}
+			if got := req.header.Get("Content-Type"); got != "application/json; serialization=Avro" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if got := req.header.Get("Authorization"); got != "" {
+				t.Errorf("Authorization = %q, want none without a service principal", got)
+			}
+			if req.body != testSchema {
+				t.Errorf("body = %s, want the schema", req.body)
+			}
+		})
+	}
+}
+
+func TestSchemaIDErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		respond func(w http.ResponseWriter, r *http.Request)
+		want    string
+	}{
+		{
+			name: "confluent incompatible",
+			cfg:  Config{Subject: "prometheus-value", Register: true},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusConflict)
+				io.WriteString(w, `{"error_code":409,"message":"Schema being registered is incompatible"}`+"\n")
+			},
+			want: `schema registry POST /subjects/prometheus-value/versions: 409 Conflict: {"error_code":409,"message":"Schema being registered is incompatible"}`,
+		},
+		{
+			name: "confluent subject not found",
+			cfg:  Config{Subject: "prometheus-value"},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `{"error_code":40401,"message":"Subject not found."}`)
+			},
+			want: `schema registry POST /subjects/prometheus-value: 404 Not Found: {"error_code":40401,"message":"Subject not found."}`,
+		},
+		{
+			name: "confluent no id",
+			cfg:  Config{Subject: "prometheus-value"},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"subject":"prometheus-value","version":1}`)
+			},
+			want: "schema registry response has no id",
+		},
+		{
+			name: "confluent invalid response",
+			cfg:  Config{Subject: "prometheus-value"},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `<html>proxy error</html>`)
+			},
+			want: "decode schema registry response: ",
+		},
+		{
+			name: "azure unauthorized",
+			cfg:  Config{Type: AzureType, Group: "metrics", Subject: "prometheus", Register: true},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":{"code":"Unauthorized"}}`, http.StatusUnauthorized)
+			},
+			want: `schema registry PUT /$schemaGroups/metrics/schemas/prometheus: 401 Unauthorized: {"error":{"code":"Unauthorized"}}`,
+		},
+		{
+			name: "azure no schema id",
+			cfg:  Config{Type: AzureType, Group: "metrics", Subject: "prometheus"},
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			want: "schema registry response has no Schema-Id header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRegistryStandIn(t, tt.respond)
+			tt.cfg.URL = s.URL
+			client := newTestClient(t, tt.cfg)
+
+			_, err := client.SchemaID(context.Background(), testSchema)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want %q", err, tt.want)
+			}
+
+			// Failures are not cached
+			client.SchemaID(context.Background(), testSchema)
+			if len(s.requests) != 2 {
+				t.Errorf("registry received %d requests, want a retry after the failure", len(s.requests))
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{name: "no subject", cfg: Config{URL: "http://localhost:8081"}, want: "schema registry subject must not be empty"},
+		{name: "azure no group", cfg: Config{URL: "https://ns.servicebus.windows.net", Type: AzureType, Subject: "s"}, want: "azure schema registry group must not be empty"},
+		{name: "unknown type", cfg: Config{URL: "http://localhost:8081", Type: "Apicurio", Subject: "s"}, want: "Unknown schema registry type: 'apicurio'"},
+		{name: "invalid url", cfg: Config{URL: "://localhost", Subject: "s"}, want: "invalid schema registry url: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClient(&tt.cfg)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// stubAvro is an avro serializer producing fixed data.
+type stubAvro struct {
+	contentType string
+}
+
+func (s stubAvro) Serialize(model.Sample) ([]byte, error) { return []byte("data"), nil }
+func (s stubAvro) ADXFormat() kusto.DataFormat            { return kusto.AVROFormat }
+func (s stubAvro) ADXColumns() []kusto.Column             { return nil }
+func (s stubAvro) ContentType() string                    { return s.contentType }
+func (s stubAvro) AvroSchema() string                     { return testSchema }
+
+func TestSerializerEncoding(t *testing.T) {
+	s := newRegistryStandIn(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":258}`)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		client := newTestClient(t, Config{URL: s.URL, Subject: "prometheus-value", Encoding: PrefixEncoding})
+		ser, err := NewSerializer(context.Background(), client, stubAvro{contentType: avrojson.BinaryContentType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ser.Serialize(model.Sample{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{0, 0, 0, 1, 2, 'd', 'a', 't', 'a'}; !bytes.Equal(got, want) {
+			t.Errorf("Serialize = %v, want %v", got, want)
+		}
+		if ser.ContentType() != avrojson.BinaryContentType {
+			t.Errorf("ContentType = %q", ser.ContentType())
+		}
+	})
+
+	t.Run("property", func(t *testing.T) {
+		client := newTestClient(t, Config{URL: s.URL, Subject: "prometheus-value"})
+		ser, err := NewSerializer(context.Background(), client, stubAvro{contentType: avrojson.BinaryContentType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ser.Serialize(model.Sample{})
+		if string(got) != "data" {
+			t.Errorf("Serialize = %q, want the unprefixed data", got)
+		}
+		if want := avrojson.BinaryContentType + "+258"; ser.ContentType() != want {
+			t.Errorf("ContentType = %q, want %q", ser.ContentType(), want)
+		}
+		if ser.EventProperties()[SchemaIDProperty] != "258" {
+			t.Errorf("EventProperties = %v", ser.EventProperties())
+		}
+	})
+
+	t.Run("prefix requires binary avro", func(t *testing.T) {
+		client := newTestClient(t, Config{URL: s.URL, Subject: "prometheus-value", Encoding: PrefixEncoding})
+		_, err := NewSerializer(context.Background(), client, stubAvro{contentType: "application/json"})
+		if err == nil {
+			t.Error("prefix encoding of avro-json succeeded")
+		}
+	})
+}
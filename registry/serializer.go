@@ -0,0 +1,136 @@
+package registry
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/avrojson"
+)
+
+const (
+	// PropertyEncoding attaches the schema ID as an event property.
+	PropertyEncoding = "property"
+	// PrefixEncoding prefixes each payload with the schema ID using the Confluent wire format.
+	PrefixEncoding = "prefix"
+
+	// SchemaIDProperty is the event property holding the schema ID.
+	SchemaIDProperty = "Schema-Id"
+
+	// confluentMagicByte starts a Confluent wire format payload.
+	confluentMagicByte = 0
+)
+
+// avroSerializer is a serializer with an avro schema
+type avroSerializer interface {
+	serializers.Serializer
+	AvroSchema() string
+}
+
+// Serializer wraps an avro serializer, attaching the registry schema ID to events
+type Serializer struct {
+	serializers.Serializer
+	schemaID    string
+	prefix      []byte
+	contentType string
+}
+
+// NewSerializer resolves the schema ID of an avro serializer and wraps it
+//
+// returns an error if the serializer has no avro schema, or the encoding is not
+// possible for the serializer and registry.
+func NewSerializer(ctx context.Context, client *Client, ser serializers.Serializer) (*Serializer, error) {
+	avro, ok := ser.(avroSerializer)
+	if !ok {
+		return nil, errors.New("schema registry requires an avro serializer")
+	}
+
+	id, err := client.SchemaID(ctx, avro.AvroSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := &Serializer{
+		Serializer:  ser,
+		schemaID:    id,
+		contentType: ser.ContentType(),
+	}
+
+	switch strings.ToLower(client.cfg.Encoding) {
+	case PropertyEncoding, "":
+		if ser.ContentType() == avrojson.BinaryContentType {
+			// Azure Schema Registry content type convention
+			wrapped.contentType = avrojson.BinaryContentType + "+" + id
+		}
+	case PrefixEncoding:
+		if ser.ContentType() != avrojson.BinaryContentType {
+			return nil, errors.New("schema registry prefix encoding requires the binary avro serializer")
+		}
+		numericID, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("schema registry prefix encoding requires a numeric schema id, got '%s'", id)
+		}
+		wrapped.prefix = make([]byte, 5)
+		wrapped.prefix[0] = confluentMagicByte
+		binary.BigEndian.PutUint32(wrapped.prefix[1:], uint32(numericID))
+	default:
+		return nil, fmt.Errorf("Unknown schema registry encoding: '%s'", strings.ToLower(client.cfg.Encoding))
+	}
+
+	return wrapped, nil
+}
+
+// Serialize takes a single Prometheus sample and turns it into a byte buffer.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) Serialize(sample model.Sample) ([]byte, error) {
+	serialized, err := s.Serializer.Serialize(sample)
+	if err != nil || s.prefix == nil {
+		return serialized, err
+	}
+
+	return append(append(make([]byte, 0, len(s.prefix)+len(serialized)), s.prefix...), serialized...), nil
+}
+
+// ContentType MIME type of the serialized data.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ContentType() string {
+	return s.contentType
+}
+
+// EventProperties returns the properties added to every event.
+//
+// Implements the serializers.EventProperties interface
+func (s *Serializer) EventProperties() map[string]interface{} {
+	return map[string]interface{}{
+		SchemaIDProperty: s.schemaID,
+	}
+}
+
+// SchemaID returns the registry ID of the serializer schema
+func (s *Serializer) SchemaID() string {
+	return s.schemaID
+}
@@ -0,0 +1,454 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/hub"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/otlp"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+// watchDelay waits for a burst of file events, such as an editor saving, to end before reloading.
+const watchDelay = 500 * time.Millisecond
+
+// configMu guards viper while a reload replaces the configuration.
+//
+// Settings read after startup, outside of a reload, hold the read lock.
+var configMu sync.RWMutex
+
+// swapWriter is a writer whose destination writer is replaced when the configuration is reloaded
+type swapWriter struct {
+	mu     sync.RWMutex
+	active *activeWriter
+}
+
+// activeWriter tracks the writes in progress on a writer.
+type activeWriter struct {
+	writer
+	writes sync.WaitGroup
+}
+
+// newSwapWriter creates a swapWriter writing to w
+func newSwapWriter(w writer) *swapWriter {
+	return &swapWriter{active: &activeWriter{writer: w}}
+}
+
+// acquire returns the current writer, which is not closed until released with writes.Done()
+func (s *swapWriter) acquire() *activeWriter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.active.writes.Add(1)
+	return s.active
+}
+
+// swap replaces the current writer, returning the previous writer
+func (s *swapWriter) swap(w writer) *activeWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.active
+	s.active = &activeWriter{writer: w}
+	return previous
+}
+
+// Write writes samples with the current writer
+func (s *swapWriter) Write(ctx context.Context, samples model.Samples) (remote.Result, error) {
+	a := s.acquire()
+	defer a.writes.Done()
+	return a.Write(ctx, samples)
+}
+
+// Name identifies the current writer
+func (s *swapWriter) Name() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active.Name()
+}
+
+// ResetConfig resets the current writer, when it reconnects after send failures
+func (s *swapWriter) ResetConfig(cfg *hub.EventHubConfig) error {
+	a := s.acquire()
+	defer a.writes.Done()
+	if r, ok := a.writer.(resetter); ok {
+		return r.ResetConfig(cfg)
+	}
+	return nil
+}
+
+// Ping checks the connection of the current writer
+func (s *swapWriter) Ping(ctx context.Context) error {
+	a := s.acquire()
+	defer a.writes.Done()
+	if p, ok := a.writer.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close drains and closes the current writer
+func (s *swapWriter) Close(ctx context.Context) error {
+	s.mu.RLock()
+	a := s.active
+	s.mu.RUnlock()
+	return a.drain(ctx)
+}
+
+// drain waits for the writes in progress to finish, or the context to be done, and closes the writer
+func (a *activeWriter) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		a.writes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Str("writer", a.Name()).Msg("closing writer with writes in progress")
+	}
+	return a.Close(ctx)
+}
+
+// handlerSettings are the settings of the request handlers, replaced when the configuration is reloaded
+type handlerSettings struct {
+	limits atomic.Pointer[requestLimits]
+	otlp   atomic.Pointer[otlp.Options]
+}
+
+// handlers are the settings of the request handlers in use.
+var handlers = &handlerSettings{}
+
+// load reads the request handler settings, guarded by configMu
+func (h *handlerSettings) load() {
+	h.limits.Store(getRequestLimits())
+	h.otlp.Store(getOTLPOptions())
+}
+
+// restartSettings are only applied at startup, a reload logs a warning when they change.
+var restartSettings = []string{
+	"listen_address",
+	"read_timeout",
+	"write_timeout",
+	"write_path",
+	"read_path",
+	"otlp_path",
+	"influx_path",
+	"telemetry_path",
+	"status_enabled",
+	"adx_read_table",
+	"read_max_samples",
+	"config_watch",
+}
+
+// reloader applies configuration reloads one at a time
+type reloader struct {
+	writer *swapWriter
+	// applied is the content of the configuration file in use
+	applied []byte
+	// secrets are the secrets read from files in use
+	secrets map[string]string
+	// settings are the settings the writer in use was created from
+	settings *writerSettings
+}
+
+// candidate is a validated configuration which is not in use yet.
+type candidate struct {
+	data     []byte
+	secrets  map[string]string
+	settings *writerSettings
+}
+
+// newReloader creates a reloader swapping the writer of w, which was created from settings
+func newReloader(w *swapWriter, settings *writerSettings) *reloader {
+	r := &reloader{writer: w, secrets: secretValues, settings: settings}
+	if file := viper.ConfigFileUsed(); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.ErrorObj(err).Str("file", file).Msg("Failed to read configuration file")
+		}
+		r.applied = data
+	}
+	return r
+}
+
+// run reloads the configuration on SIGHUP and, when watching, on changes of the configuration file
+//
+// Returns when the context is done.
+func (r *reloader) run(ctx context.Context, watch bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var changed <-chan struct{}
+	if file := viper.ConfigFileUsed(); watch && file != "" {
+		watcher, ch, err := watchFiles(file)
+		if err != nil {
+			log.ErrorObj(err).Str("file", file).Msg("Failed to watch configuration file")
+		} else {
+			defer watcher.Close()
+			changed = ch
+		}
+	}
+
+	// Secret files are always watched, to pick up rotated credentials
+	var rotated <-chan struct{}
+	if files := secretFiles(); len(files) > 0 {
+		watcher, ch, err := watchFiles(files...)
+		if err != nil {
+			log.ErrorObj(err).Strs("files", files).Msg("Failed to watch secret files")
+		} else {
+			defer watcher.Close()
+			rotated = ch
+		}
+	}
+
+	for {
+		var trigger string
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			trigger = "signal"
+		case <-changed:
+			trigger = "file"
+		case <-rotated:
+			trigger = "secret"
+		}
+
+		// A signal always reconnects, file changes only when the writer settings changed
+		recreated, err := r.reload(trigger == "signal")
+		if err != nil {
+			configReloads.WithLabelValues("failure").Inc()
+			configReloadSuccess.Set(0)
+			log.ErrorObj(err).Str("trigger", trigger).Msg("Configuration reload failed, keeping the previous configuration")
+			continue
+		}
+		configReloads.WithLabelValues("success").Inc()
+		configReloadSuccess.Set(1)
+		configReloadTime.SetToCurrentTime()
+		log.Info().Str("trigger", trigger).Str("writer", r.writer.Name()).Bool("writer_recreated", recreated).Msg("Configuration reloaded")
+	}
+}
+
+// reload re-reads the configuration and secret files and applies them
+//
+// The configuration is validated like at startup. A writer is created from
+// it when recreate is set or its writer settings changed, such as a rotated
+// secret the destination uses, and the configuration fails when the writer
+// can't be created. On failure the previous configuration stays in use.
+//
+// The writer is created while settings stay readable, configMu is only held
+// exclusively to validate and to swap in the configuration and writer. The
+// previous writer is closed once its writes in progress finish.
+//
+// returns whether the writer was recreated.
+func (r *reloader) reload(recreate bool) (bool, error) {
+	c, err := r.prepare()
+	if err != nil {
+		return false, err
+	}
+
+	var w writer
+	if recreate || !reflect.DeepEqual(c.settings, r.settings) {
+		w, err = newWriter(c.settings)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	configMu.Lock()
+	if c.data != nil {
+		if err := viper.ReadConfig(bytes.NewReader(c.data)); err != nil {
+			// Parsed when validated, not expected to fail
+			r.restore()
+			configMu.Unlock()
+			if w != nil {
+				w.Close(context.Background())
+			}
+			return false, err
+		}
+	}
+	secretValues = c.secrets
+	r.applied, r.secrets = c.data, c.secrets
+
+	var previous *activeWriter
+	if w != nil {
+		previous = r.writer.swap(w)
+		r.settings = c.settings
+	}
+	handlers.load()
+	configureHealth()
+	configLogging()
+	drainTimeout := viper.GetDuration("write_timeout")
+	configMu.Unlock()
+
+	if previous != nil {
+		go func() {
+			drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			if err := previous.drain(drainCtx); err != nil {
+				log.ErrorObj(err).Str("writer", previous.Name()).Msg("Failed to close previous writer")
+			}
+		}()
+	}
+	return w != nil, nil
+}
+
+// prepare reads and validates the configuration and secret files
+//
+// The configuration in use is restored before returning, the candidate is
+// applied once its writer was created.
+func (r *reloader) prepare() (*candidate, error) {
+	c := &candidate{}
+	if file := viper.ConfigFileUsed(); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		c.data = data
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	defer r.restore()
+
+	previous := make(map[string]interface{}, len(restartSettings))
+	for _, key := range restartSettings {
+		previous[key] = viper.Get(key)
+	}
+
+	if c.data != nil {
+		if err := viper.ReadConfig(bytes.NewReader(c.data)); err != nil {
+			return nil, err
+		}
+	}
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		return nil, err
+	}
+	secretValues = secrets
+	c.secrets = secrets
+
+	problems, warnings := splitWarnings(validateConfig())
+	if len(problems) > 0 {
+		return nil, problemsError(problems)
+	}
+	logWarnings(warnings)
+
+	for _, key := range restartSettings {
+		if !reflect.DeepEqual(previous[key], viper.Get(key)) {
+			log.Warn().Str("setting", key).Msg("Setting changed, it takes effect on restart")
+		}
+	}
+
+	c.settings = getWriterSettings()
+	return c, nil
+}
+
+// restore puts back the configuration in use, guarded by configMu
+func (r *reloader) restore() {
+	secretValues = r.secrets
+	if r.applied == nil {
+		return
+	}
+	if err := viper.ReadConfig(bytes.NewReader(r.applied)); err != nil {
+		log.ErrorObj(err).Msg("Failed to restore configuration")
+	}
+}
+
+// watchFiles signals changes of files, after a burst of changes ends
+//
+// The directories are watched, so replacing a file, or the symlink swap of a
+// mounted Kubernetes ConfigMap or Secret, is noticed.
+func watchFiles(files ...string) (*fsnotify.Watcher, <-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// targets are the files symlinks resolve to, by file
+	targets := make(map[string]string, len(files))
+	for _, file := range files {
+		file = filepath.Clean(file)
+		if _, ok := targets[file]; ok {
+			continue
+		}
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return nil, nil, err
+		}
+		targets[file], _ = filepath.EvalSymlinks(file)
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				modified := false
+				for file, target := range targets {
+					current, _ := filepath.EvalSymlinks(file)
+					written := filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+					if !written && (current == "" || current == target) {
+						continue
+					}
+					targets[file] = current
+					modified = true
+				}
+				if !modified {
+					continue
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDelay, func() {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.ErrorObj(err).Strs("files", files).Msg("configuration file watch error")
+			}
+		}
+	}()
+	return watcher, changed, nil
+}
@@ -0,0 +1,100 @@
+package remote
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// ChunkedReadContentType is the content type of a streamed remote read response.
+	ChunkedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+	// MaxSamplesPerChunk is the number of samples encoded in a chunk, as used by Prometheus.
+	MaxSamplesPerChunk = 120
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkedWriter writes the frames of a streamed remote read response
+//
+// Each frame is the uvarint size of the message, its big-endian CRC32
+// (Castagnoli) checksum and the message itself.
+type ChunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// NewChunkedWriter creates a writer flushing every frame to the client
+func NewChunkedWriter(w io.Writer, flusher http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{w: w, flusher: flusher}
+}
+
+// Write writes a single frame
+func (cw *ChunkedWriter) Write(msg []byte) (int, error) {
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(msg)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(msg, castagnoli))
+
+	if _, err := cw.w.Write(header[:n+4]); err != nil {
+		return 0, err
+	}
+	written, err := cw.w.Write(msg)
+	if err != nil {
+		return written, err
+	}
+
+	if cw.flusher != nil {
+		cw.flusher.Flush()
+	}
+	return written, nil
+}
+
+// EncodeChunks encodes samples sorted by timestamp into XOR chunks
+func EncodeChunks(samples []prompb.Sample) ([]prompb.Chunk, error) {
+	var chunks []prompb.Chunk
+
+	for start := 0; start < len(samples); start += MaxSamplesPerChunk {
+		end := start + MaxSamplesPerChunk
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples[start:end] {
+			app.Append(s.Timestamp, s.Value)
+		}
+
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[start].Timestamp,
+			MaxTimeMs: samples[end-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      chk.Bytes(),
+		})
+	}
+
+	return chunks, nil
+}
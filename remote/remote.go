@@ -0,0 +1,49 @@
+// Package remote provides types shared by the remote storage writers.
+package remote
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+// Result counts the outcome of each sample passed to a writer.
+type Result struct {
+	// Sent is the number of samples accepted by the remote storage.
+	Sent int
+	// SerializeFailed is the number of samples which could not be serialized.
+	SerializeFailed int
+	// SendFailed is the number of samples rejected by, or not delivered to, the remote storage.
+	SendFailed int
+	// Dropped is the number of samples intentionally not sent.
+	Dropped int
+	// Bytes is the size of the serialized events before compression.
+	Bytes int
+	// CompressedBytes is the size of the serialized events after compression.
+	CompressedBytes int
+}
+
+// Total returns the number of samples accounted for.
+func (r Result) Total() int {
+	return r.Sent + r.SerializeFailed + r.SendFailed + r.Dropped
+}
+
+// Add sums the counts of another result into r.
+func (r *Result) Add(other Result) {
+	r.Sent += other.Sent
+	r.SerializeFailed += other.SerializeFailed
+	r.SendFailed += other.SendFailed
+	r.Dropped += other.Dropped
+	r.Bytes += other.Bytes
+	r.CompressedBytes += other.CompressedBytes
+}
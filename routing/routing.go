@@ -0,0 +1,229 @@
+// Package routing builds the Azure Data Explorer routing properties attached to
+// single events from templates over a sample's metric name and labels.
+package routing
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+)
+
+const (
+	// DefaultTable is the table template used when none is configured.
+	// Routes every sample to a table named after its metric.
+	DefaultTable = "{{ .Name }}"
+	// DefaultFallbackTable is the table used when a template produces no usable name.
+	DefaultFallbackTable = "prometheus"
+)
+
+// Config for routing single events
+type Config struct {
+	// Table is a template for the "Table" event property.
+	Table string
+	// FallbackTable is used when Table renders an invalid or empty name.
+	FallbackTable string
+	// Mapping is a template for the "IngestionMappingReference" event property.
+	Mapping string
+	// Properties are templates for additional event properties, keyed by property name.
+	Properties map[string]string
+}
+
+// Data is the value templates are executed against.
+type Data struct {
+	// Name is the sample metric name.
+	Name string
+	// Labels is the sample label set, excluding the metric name.
+	Labels map[string]string
+}
+
+// NewData creates template data from a Prometheus metric
+func NewData(metric model.Metric) Data {
+	labels := make(map[string]string, len(metric))
+	for label, value := range metric {
+		if label != model.MetricNameLabel {
+			labels[string(label)] = string(value)
+		}
+	}
+
+	return Data{
+		Name:   string(metric[model.MetricNameLabel]),
+		Labels: labels,
+	}
+}
+
+// PartitionKey returns the value of the partition key label of a metric
+//
+// returns false when no label is configured or the metric does not have it.
+func PartitionKey(metric model.Metric, label string) (string, bool) {
+	if label == "" {
+		return "", false
+	}
+	value, ok := metric[model.LabelName(label)]
+	return string(value), ok
+}
+
+// Template is a parsed routing template
+type Template struct {
+	tmpl *template.Template
+}
+
+// funcs are the helper functions available to routing templates.
+var funcs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"table":      kusto.TableName,
+}
+
+// NewTemplate parses a routing template
+func NewTemplate(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s template: %w", name, err)
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Execute renders the template for the given data
+func (t *Template) Execute(data Data) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Router creates event properties for samples
+type Router struct {
+	table         *Template
+	fallbackTable string
+	mapping       *Template
+	properties    map[string]*Template
+}
+
+// New creates a Router from the configuration
+func New(cfg *Config) (*Router, error) {
+	tableText := cfg.Table
+	if tableText == "" {
+		tableText = DefaultTable
+	}
+	table, err := NewTemplate("table", tableText)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback := cfg.FallbackTable
+	if fallback == "" {
+		fallback = DefaultFallbackTable
+	}
+	if kusto.TableName(fallback) != fallback {
+		return nil, fmt.Errorf("fallback table %q is not a valid table name", fallback)
+	}
+
+	mapping, err := NewTemplate("mapping", cfg.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]*Template, len(cfg.Properties))
+	for name, text := range cfg.Properties {
+		if name == "" {
+			return nil, errors.New("event property name must not be empty")
+		}
+		tmpl, err := NewTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+		properties[name] = tmpl
+	}
+
+	return &Router{
+		table:         table,
+		fallbackTable: fallback,
+		mapping:       mapping,
+		properties:    properties,
+	}, nil
+}
+
+// Table returns the sanitized table name for the data
+//
+// Falls back to the static fallback table when the template fails or renders
+// a name that cannot be made valid.
+func (r *Router) Table(data Data) string {
+	rendered, err := r.table.Execute(data)
+	if err != nil {
+		log.Warn().Err(err).Str("metric", data.Name).Msg("table template failed, using fallback table")
+		return r.fallbackTable
+	}
+
+	table := kusto.TableName(rendered)
+	if table == "" {
+		log.Debug().Str("metric", data.Name).Msg("table template rendered an empty name, using fallback table")
+		return r.fallbackTable
+	}
+	return table
+}
+
+// Mapping returns the ingestion mapping reference for the data
+func (r *Router) Mapping(data Data) string {
+	mapping, err := r.mapping.Execute(data)
+	if err != nil {
+		log.Warn().Err(err).Str("metric", data.Name).Msg("mapping template failed")
+		return ""
+	}
+	return mapping
+}
+
+// Properties returns the event properties for a sample
+//
+// The routing properties are only set for formats Azure Data Explorer can
+// ingest. Extra properties are rendered first so they can never override the
+// Table, Format and IngestionMappingReference routing properties.
+func (r *Router) Properties(metric model.Metric, format kusto.DataFormat) map[string]interface{} {
+	data := NewData(metric)
+
+	props := make(map[string]interface{}, len(r.properties)+3)
+	for name, tmpl := range r.properties {
+		value, err := tmpl.Execute(data)
+		if err != nil {
+			log.Warn().Err(err).Str("metric", data.Name).Str("property", name).Msg("property template failed, property not set")
+			continue
+		}
+		props[name] = value
+	}
+
+	// Formats Azure Data Explorer can't ingest are not routed
+	if !format.IsADX() {
+		return props
+	}
+
+	props["Table"] = r.Table(data)
+	props["Format"] = format.String()
+	props["IngestionMappingReference"] = r.Mapping(data)
+
+	return props
+}
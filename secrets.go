@@ -0,0 +1,94 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/redact"
+)
+
+// secretFileSuffix is appended to a secret setting to name the setting of the file holding it.
+const secretFileSuffix = "_file"
+
+// secretKeys are the settings holding credentials, each has a "_file" variant.
+var secretKeys = []string{
+	"write_keyvalue",
+	"write_connstring",
+	"write_clientsecret",
+	"write_certpassword",
+	"write_proxy_url",
+	"registry_password",
+	"kafka_password",
+}
+
+// settingsRedactor hides secrets when settings are logged or displayed.
+var settingsRedactor = redact.New(secretKeys...)
+
+// secretValues are the secrets read from files, by setting.
+//
+// Loaded at startup and on each reload, guarded by configMu.
+var secretValues = map[string]string{}
+
+// secretString returns the value of a secret setting, read from its file when one is set
+func secretString(key string) string {
+	if value, ok := secretValues[key]; ok {
+		return value
+	}
+	return viper.GetString(key)
+}
+
+// readSecretFile reads a secret from a file, without the trailing newline
+func readSecretFile(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadSecrets reads the secrets of the settings whose file is set
+func loadSecrets() (map[string]string, error) {
+	values := make(map[string]string)
+	for _, key := range secretKeys {
+		file := viper.GetString(key + secretFileSuffix)
+		if file == "" {
+			continue
+		}
+		value, err := readSecretFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key+secretFileSuffix, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// secretFiles returns the secret files in use
+func secretFiles() []string {
+	var files []string
+	for _, key := range secretKeys {
+		if file := viper.GetString(key + secretFileSuffix); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
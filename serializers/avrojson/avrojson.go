@@ -17,16 +17,18 @@ package avrojson
 */
 
 import (
-	"time"
+	"encoding/json"
+	"errors"
 
 	"github.com/linkedin/goavro/v2"
 	"github.com/prometheus/common/model"
 
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
 )
 
 const (
-	// SCHEMA is the avro schema used for serialization
+	// SCHEMA is the avro schema generated for the default options
 	SCHEMA = `{
 		"namespace": "io.prometheus",
 		"type": "record",
@@ -41,43 +43,132 @@ const (
 	}`
 )
 
+// NewSchema returns the avro schema used for serialization with the given options
+//
+// Flattened labels are not supported, since an avro record has a fixed set of fields.
+func NewSchema(opts *record.Options) (string, error) {
+	if opts.Fields.Flatten {
+		return "", errors.New("avro schema does not support flattened labels, promote labels instead")
+	}
+
+	layout := opts.Layout()
+	fields := make([]map[string]interface{}, 0, len(layout))
+	for _, field := range layout {
+		var fieldType interface{}
+		switch field.Kind {
+		case record.ValueField:
+			fieldType = "double"
+			if opts.Values.Nullable() {
+				fieldType = []string{"null", "double"}
+			}
+		case record.LabelsField:
+			fieldType = map[string]string{"type": "map", "values": "string"}
+		case record.StaleField:
+			fieldType = "boolean"
+		default:
+			fieldType = "string"
+		}
+		fields = append(fields, map[string]interface{}{"name": field.Name, "type": fieldType})
+	}
+
+	schema, err := json.Marshal(map[string]interface{}{
+		"namespace": "io.prometheus",
+		"type":      "record",
+		"name":      "Metric",
+		"doc":       "A basic schema for representing Prometheus metrics",
+		"fields":    fields,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(schema), nil
+}
+
+// BinaryContentType is the MIME type of binary encoded avro data.
+const BinaryContentType = "avro/binary"
+
 // Serializer represents a serializer instance
 type Serializer struct {
-	Codec *goavro.Codec
+	Codec   *goavro.Codec
+	Options record.Options
+	// Binary encodes avro binary data instead of avro json.
+	Binary bool
+	layout []record.Field
+}
+
+// NewSerializer creates an avro-json Serializer for the options
+func NewSerializer(opts record.Options) (*Serializer, error) {
+	schema, err := NewSchema(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Serializer{
+		Codec:   codec,
+		Options: opts,
+		layout:  opts.Layout(),
+	}, nil
 }
 
 // ADXFormat Azure Data Explorer injestion data format.
 //
 // Implements the serializers.Serializer interface
 func (s *Serializer) ADXFormat() kusto.DataFormat {
+	if s.Binary {
+		// Azure Data Explorer only ingests avro container files
+		return kusto.NoFormat
+	}
 	return kusto.JSONFormat
 }
 
-// Serialize takes a single Prometheus sample and turns it into a byte buffer.
+// ADXColumns Azure Data Explorer table columns matching the serialized data.
 //
 // Implements the serializers.Serializer interface
-func (s *Serializer) Serialize(sample model.Sample) ([]byte, error) {
-	m := s.createObject(sample)
-	return s.Codec.TextualFromNative(nil, m)
+func (s *Serializer) ADXColumns() []kusto.Column {
+	if s.Binary {
+		return nil
+	}
+	return record.Columns(s.layout)
 }
 
-func (s *Serializer) createObject(sample model.Sample) map[string]interface{} {
-	metricName := sample.Metric[model.MetricNameLabel]
+// ContentType MIME type of the serialized data.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ContentType() string {
+	if s.Binary {
+		return BinaryContentType
+	}
+	return "application/json"
+}
 
-	// Remove sample name from labels set
-	labels := make(map[string]string, (len(sample.Metric) - 1))
-	for label, value := range sample.Metric {
-		if label != model.MetricNameLabel {
-			labels[string(label)] = string(value)
-		}
+// AvroSchema returns the avro schema of the serialized data.
+func (s *Serializer) AvroSchema() string {
+	return s.Codec.Schema()
+}
+
+// Serialize takes a single Prometheus sample and turns it into a byte buffer.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) Serialize(sample model.Sample) ([]byte, error) {
+	r, err := record.New(sample, &s.Options)
+	if err != nil {
+		return []byte{}, err
 	}
 
-	m := map[string]interface{}{
-		"timestamp": time.Unix(0, sample.Timestamp.UnixNano()).UTC().Format(time.RFC3339),
-		"value":     float64(sample.Value),
-		"name":      string(metricName),
-		"labels":    labels,
+	m := r.Object(&s.Options, s.layout)
+
+	// Nullable values are encoded as an avro union
+	if s.Options.Values.Nullable() && r.Value != nil {
+		m[s.Options.Fields.Value] = goavro.Union("double", r.Value)
 	}
 
-	return m
+	if s.Binary {
+		return s.Codec.BinaryFromNative(nil, m)
+	}
+	return s.Codec.TextualFromNative(nil, m)
 }
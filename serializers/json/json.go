@@ -18,15 +18,25 @@ package json
 
 import (
 	"encoding/json"
-	"time"
 
 	"github.com/prometheus/common/model"
 
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
 )
 
 // Serializer represents a serializer instance
 type Serializer struct {
+	Options record.Options
+	layout  []record.Field
+}
+
+// NewSerializer creates a json Serializer for the options
+func NewSerializer(opts record.Options) *Serializer {
+	return &Serializer{
+		Options: opts,
+		layout:  opts.Layout(),
+	}
 }
 
 // ADXFormat Azure Data Explorer injestion data format.
@@ -36,36 +46,33 @@ func (s *Serializer) ADXFormat() kusto.DataFormat {
 	return kusto.JSONFormat
 }
 
+// ADXColumns Azure Data Explorer table columns matching the serialized data.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ADXColumns() []kusto.Column {
+	return record.Columns(s.layout)
+}
+
+// ContentType MIME type of the serialized data.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ContentType() string {
+	return "application/json"
+}
+
 // Serialize takes a single Prometheus sample and turns it into a byte buffer.
 //
 // Implements the serializers.Serializer interface
 func (s *Serializer) Serialize(sample model.Sample) ([]byte, error) {
-	m := s.createObject(sample)
-	serialized, err := json.Marshal(m)
+	r, err := record.New(sample, &s.Options)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	return serialized, nil
-}
-
-func (s *Serializer) createObject(sample model.Sample) map[string]interface{} {
-	metricName := sample.Metric[model.MetricNameLabel]
-
-	// Remove sample name from labels set
-	labels := make(map[string]string, (len(sample.Metric) - 1))
-	for label, value := range sample.Metric {
-		if label != model.MetricNameLabel {
-			labels[string(label)] = string(value)
-		}
-	}
-
-	m := map[string]interface{}{
-		"timestamp": time.Unix(0, sample.Timestamp.UnixNano()).UTC().Format(time.RFC3339),
-		"value":     float64(sample.Value),
-		"name":      string(metricName),
-		"labels":    labels,
+	serialized, err := json.Marshal(r.Object(&s.Options, s.layout))
+	if err != nil {
+		return []byte{}, err
 	}
 
-	return m
+	return serialized, nil
 }
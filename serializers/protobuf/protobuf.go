@@ -0,0 +1,110 @@
+package protobuf
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/common/model"
+	promvalue "github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+const (
+	// ContentType identifies the serialized message, an uncompressed remote write request.
+	ContentType = "application/x-protobuf; proto=prometheus.WriteRequest"
+)
+
+// Serializer represents a serializer instance
+//
+// Each sample is serialized as a prompb.WriteRequest holding a single time
+// series with a single sample, the message Prometheus uses for remote write.
+type Serializer struct {
+	Options record.Options
+}
+
+// ADXFormat Azure Data Explorer injestion data format.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ADXFormat() kusto.DataFormat {
+	return kusto.ProtobufFormat
+}
+
+// ADXColumns Azure Data Explorer table columns matching the serialized data.
+// Protobuf is not an Azure Data Explorer format, returns no columns.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ADXColumns() []kusto.Column {
+	return nil
+}
+
+// ContentType MIME type of the serialized data.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) ContentType() string {
+	return ContentType
+}
+
+// Serialize takes a single Prometheus sample and turns it into a byte buffer.
+//
+// Implements the serializers.Serializer interface
+func (s *Serializer) Serialize(sample model.Sample) ([]byte, error) {
+	value, err := s.value(float64(sample.Value))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	labels := make([]prompb.Label, 0, len(sample.Metric))
+	for name, value := range sample.Metric {
+		labels = append(labels, prompb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	req := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: value, Timestamp: int64(sample.Timestamp)}},
+		}},
+	}
+
+	return proto.Marshal(req)
+}
+
+// value applies the value policy to a sample value
+//
+// Protobuf has no null, the "null" and "field" policies keep the original NaN,
+// which preserves the Prometheus staleness marker bit pattern. Staleness
+// markers are also kept when no stale policy is set, so remote write
+// consumers don't read them as real samples.
+func (s *Serializer) value(v float64) (float64, error) {
+	if promvalue.IsStaleNaN(v) && s.Options.Values.Stale == record.DefaultPolicy {
+		return v, nil
+	}
+
+	resolved, _, err := s.Options.Values.Resolve(v)
+	if err != nil {
+		return 0, err
+	}
+	if f, ok := resolved.(float64); ok {
+		return f, nil
+	}
+	return v, nil
+}
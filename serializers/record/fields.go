@@ -0,0 +1,184 @@
+package record
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
+)
+
+// FieldKind is an enum for the source of an output field value.
+type FieldKind uint8
+
+const (
+	// TimestampField holds the sample timestamp.
+	TimestampField FieldKind = iota
+	// ValueField holds the sample value.
+	ValueField
+	// NameField holds the metric name.
+	NameField
+	// LabelsField holds the label set as a map.
+	LabelsField
+	// LabelField holds the value of a single promoted label.
+	LabelField
+	// StaticField holds a configured static value.
+	StaticField
+	// StaleField holds the staleness marker flag.
+	StaleField
+)
+
+// Fields defines the names and layout of the output fields
+type Fields struct {
+	// Timestamp is the name of the timestamp field.
+	Timestamp string
+	// Value is the name of the value field.
+	Value string
+	// Name is the name of the metric name field.
+	Name string
+	// Labels is the name of the label set field. Empty omits the label set.
+	Labels string
+	// Stale is the name of the staleness marker field, used by the "field" stale policy.
+	Stale string
+	// Promote lists labels moved out of the label set to their own top-level field.
+	Promote []string
+	// Prefix is prepended to a label name to form its top-level field name.
+	Prefix string
+	// Flatten moves every label to its own top-level field and omits the label set.
+	Flatten bool
+	// Static are fields added to every record, keyed by field name.
+	Static map[string]string
+}
+
+// DefaultFields returns the default field layout
+func DefaultFields() Fields {
+	return Fields{
+		Timestamp: "timestamp",
+		Value:     "value",
+		Name:      "name",
+		Labels:    "labels",
+		Stale:     "stale",
+		Prefix:    "labels_",
+	}
+}
+
+// Field is a top-level output field
+type Field struct {
+	// Name of the field.
+	Name string
+	// Kind is the source of the field value.
+	Kind FieldKind
+	// Label is the label name of a LabelField.
+	Label string
+	// Static is the value of a StaticField.
+	Static string
+}
+
+// Layout returns the fixed top-level fields in output order.
+//
+// Labels flattened by Fields.Flatten are not part of the layout, since they
+// depend on each sample's label set.
+func (o *Options) Layout() []Field {
+	f := &o.Fields
+
+	layout := []Field{
+		{Name: f.Timestamp, Kind: TimestampField},
+		{Name: f.Value, Kind: ValueField},
+		{Name: f.Name, Kind: NameField},
+	}
+
+	if f.Labels != "" && !f.Flatten {
+		layout = append(layout, Field{Name: f.Labels, Kind: LabelsField})
+	}
+
+	for _, label := range f.Promote {
+		layout = append(layout, Field{Name: f.Prefix + label, Kind: LabelField, Label: label})
+	}
+
+	static := make([]string, 0, len(f.Static))
+	for name := range f.Static {
+		static = append(static, name)
+	}
+	sort.Strings(static)
+	for _, name := range static {
+		layout = append(layout, Field{Name: name, Kind: StaticField, Static: f.Static[name]})
+	}
+
+	if o.Values.StaleField() {
+		layout = append(layout, Field{Name: f.Stale, Kind: StaleField})
+	}
+
+	return layout
+}
+
+// Columns returns the Azure Data Explorer columns matching a JSON encoded layout.
+func Columns(layout []Field) []kusto.Column {
+	cols := make([]kusto.Column, 0, len(layout))
+	for _, field := range layout {
+		col := kusto.Column{Name: field.Name, Path: kusto.JSONPath(field.Name)}
+		switch field.Kind {
+		case TimestampField:
+			col.Type = "datetime"
+		case ValueField:
+			col.Type = "real"
+		case NameField:
+			col.Type = "string"
+			col.MetricName = true
+		case LabelsField:
+			col.Type = "dynamic"
+		case StaleField:
+			col.Type = "bool"
+		default:
+			col.Type = "string"
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// Validate checks the options produce a usable layout.
+func (o *Options) Validate() error {
+	if err := o.Values.Validate(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{})
+	for _, field := range o.Layout() {
+		if field.Name == "" {
+			return fmt.Errorf("output field name must not be empty")
+		}
+		if _, ok := seen[field.Name]; ok {
+			return fmt.Errorf("duplicate output field name '%s'", field.Name)
+		}
+		seen[field.Name] = struct{}{}
+	}
+	return nil
+}
+
+// promoted reports whether a label has its own top-level field.
+func (o *Options) promoted(label string) bool {
+	if o.Fields.Flatten {
+		return true
+	}
+	for _, p := range o.Fields.Promote {
+		if p == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package record
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/value"
+)
+
+// Policy is an enum for the handling of NaN sample values.
+type Policy uint8
+
+const (
+	// DefaultPolicy is the policy of the serializer, ConvertPolicy unless
+	// the serializer can represent the value as is.
+	DefaultPolicy Policy = iota
+	// ConvertPolicy converts the value to a configured value.
+	ConvertPolicy
+	// DropPolicy drops the sample.
+	DropPolicy
+	// NullPolicy passes the value through as null.
+	NullPolicy
+	// FieldPolicy passes the value through as null and sets an explicit "stale" field.
+	// Only valid for staleness markers.
+	FieldPolicy
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DefaultPolicy:
+		return "default"
+	case ConvertPolicy:
+		return "value"
+	case DropPolicy:
+		return "drop"
+	case NullPolicy:
+		return "null"
+	case FieldPolicy:
+		return "field"
+	default:
+		return ""
+	}
+}
+
+// ParsePolicy converts a policy string into a Policy value.
+// returns an error if the input string does not match known values.
+func ParsePolicy(policyStr string) (Policy, error) {
+	switch strings.ToLower(policyStr) {
+	case "":
+		return DefaultPolicy, nil
+	case "value":
+		return ConvertPolicy, nil
+	case "drop":
+		return DropPolicy, nil
+	case "null":
+		return NullPolicy, nil
+	case "field":
+		return FieldPolicy, nil
+	default:
+		return DefaultPolicy, fmt.Errorf("Unknown value policy: '%s'", strings.ToLower(policyStr))
+	}
+}
+
+// ValuePolicy defines the handling of NaN values.
+//
+// Prometheus marks a series as stale with a NaN of a specific bit pattern,
+// which is handled separately from any other NaN value.
+type ValuePolicy struct {
+	// NaN applies to NaN values which are not staleness markers.
+	NaN Policy
+	// NaNValue is used by ConvertPolicy for NaN values.
+	NaNValue float64
+	// Stale applies to staleness markers.
+	Stale Policy
+	// StaleValue is used by ConvertPolicy for staleness markers.
+	StaleValue float64
+}
+
+// Validate checks the policy combination is supported.
+func (p *ValuePolicy) Validate() error {
+	if p.NaN == FieldPolicy {
+		return fmt.Errorf("value policy '%s' is only valid for staleness markers", FieldPolicy)
+	}
+	return nil
+}
+
+// StaleField reports whether records carry an explicit "stale" field.
+func (p *ValuePolicy) StaleField() bool {
+	return p.Stale == FieldPolicy
+}
+
+// Nullable reports whether record values can be null.
+func (p *ValuePolicy) Nullable() bool {
+	return p.NaN == NullPolicy || p.Stale == NullPolicy || p.Stale == FieldPolicy
+}
+
+// Resolve applies the policy to a sample value.
+//
+// returns the value to serialize, a float64 or nil, whether the value is a
+// staleness marker, and ErrDropped if the sample should not be sent.
+func (p *ValuePolicy) Resolve(v float64) (interface{}, bool, error) {
+	if !math.IsNaN(v) {
+		return v, false, nil
+	}
+
+	if value.IsStaleNaN(v) {
+		switch p.Stale {
+		case DropPolicy:
+			return nil, true, ErrDropped
+		case NullPolicy, FieldPolicy:
+			return nil, true, nil
+		default:
+			return p.StaleValue, true, nil
+		}
+	}
+
+	switch p.NaN {
+	case DropPolicy:
+		return nil, false, ErrDropped
+	case NullPolicy:
+		return nil, false, nil
+	default:
+		return p.NaNValue, false, nil
+	}
+}
@@ -0,0 +1,119 @@
+// Package record builds the event record shared by the serializers.
+package record
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// ErrDropped is returned when a value policy drops a sample.
+var ErrDropped = errors.New("sample dropped by value policy")
+
+// Options for building records
+type Options struct {
+	// Values is the NaN and staleness marker policy.
+	Values ValuePolicy
+	// Fields is the output field layout.
+	Fields Fields
+}
+
+// Record is a sample converted by the value policy.
+type Record struct {
+	// Timestamp of the sample in RFC3339 UTC.
+	Timestamp string
+	// Value is a float64, or nil for a null value.
+	Value interface{}
+	// Stale is true when the sample is a Prometheus staleness marker.
+	Stale bool
+	// Name is the metric name.
+	Name string
+	// Labels is the label set without the metric name.
+	Labels map[string]string
+}
+
+// New converts a sample into a record
+//
+// returns ErrDropped if the value policy drops the sample.
+func New(sample model.Sample, opts *Options) (*Record, error) {
+	value, stale, err := opts.Values.Resolve(float64(sample.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove sample name from labels set
+	labels := make(map[string]string, len(sample.Metric))
+	for label, value := range sample.Metric {
+		if label != model.MetricNameLabel {
+			labels[string(label)] = string(value)
+		}
+	}
+
+	return &Record{
+		Timestamp: time.Unix(0, sample.Timestamp.UnixNano()).UTC().Format(time.RFC3339),
+		Value:     value,
+		Stale:     stale,
+		Name:      string(sample.Metric[model.MetricNameLabel]),
+		Labels:    labels,
+	}, nil
+}
+
+// Object returns the record as a map of field names to values.
+//
+// layout is the result of opts.Layout(), computed once by the caller.
+func (r *Record) Object(opts *Options, layout []Field) map[string]interface{} {
+	m := make(map[string]interface{}, len(layout))
+
+	for _, field := range layout {
+		switch field.Kind {
+		case TimestampField:
+			m[field.Name] = r.Timestamp
+		case ValueField:
+			m[field.Name] = r.Value
+		case NameField:
+			m[field.Name] = r.Name
+		case LabelsField:
+			labels := make(map[string]string, len(r.Labels))
+			for label, value := range r.Labels {
+				if !opts.promoted(label) {
+					labels[label] = value
+				}
+			}
+			m[field.Name] = labels
+		case LabelField:
+			m[field.Name] = r.Labels[field.Label]
+		case StaticField:
+			m[field.Name] = field.Static
+		case StaleField:
+			m[field.Name] = r.Stale
+		}
+	}
+
+	if opts.Fields.Flatten {
+		for label, value := range r.Labels {
+			// Fixed fields take precedence over a flattened label of the same name
+			if _, ok := m[opts.Fields.Prefix+label]; !ok {
+				m[opts.Fields.Prefix+label] = value
+			}
+		}
+	}
+
+	return m
+}
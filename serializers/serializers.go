@@ -27,13 +27,14 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/linkedin/goavro/v2"
 	"github.com/prometheus/common/model"
 
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/kusto"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/avrojson"
 	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/json"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/protobuf"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
 )
 
 // Serializer is an interface defining functions that a serializer must satisfy.
@@ -43,24 +44,54 @@ type Serializer interface {
 
 	// ADXFormat Azure Data Explorer injestion data format.
 	ADXFormat() kusto.DataFormat
+
+	// ADXColumns Azure Data Explorer table columns matching the serialized data.
+	ADXColumns() []kusto.Column
+
+	// ContentType MIME type of the serialized data.
+	ContentType() string
+}
+
+// EventProperties is implemented by serializers which add properties to every event.
+type EventProperties interface {
+	// EventProperties returns the properties added to every event.
+	EventProperties() map[string]interface{}
 }
 
+// ErrDropped is returned by Serialize when a sample is intentionally not serialized.
+var ErrDropped = record.ErrDropped
+
 // SerializerConfig is a struct that covers the data types needed for all serializer types,
 // and can be used to instantiate _any_ of the serializers.
 type SerializerConfig struct {
 	// Dataformat can be one of the serializer types listed in serializers.NewSerializer.
 	DataFormat string
+
+	// Values defines the handling of NaN values and staleness markers.
+	Values record.ValuePolicy
+
+	// Fields defines the output field names and layout.
+	Fields record.Fields
 }
 
 // NewSerializer provides a Serializer based on the given config.
 //
 // Parses SerializerConfig.DataFormat string
 func NewSerializer(cfg *SerializerConfig) (Serializer, error) {
+	opts := record.Options{Values: cfg.Values, Fields: cfg.Fields}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
 	switch strings.ToLower(cfg.DataFormat) {
 	case "json":
-		return NewJSONSerializer()
+		return NewJSONSerializer(opts)
 	case "avro-json":
-		return NewAvroJSONSerializer()
+		return NewAvroJSONSerializer(opts)
+	case "avro":
+		return NewAvroSerializer(opts)
+	case "protobuf":
+		return NewProtobufSerializer(opts)
 	default:
 		err := fmt.Errorf("Invalid data format: %s", strings.ToLower(cfg.DataFormat))
 		return nil, err
@@ -68,19 +99,36 @@ func NewSerializer(cfg *SerializerConfig) (Serializer, error) {
 }
 
 // NewJSONSerializer provides a 'json' Serializer
-func NewJSONSerializer() (Serializer, error) {
-	return &json.Serializer{}, nil
+func NewJSONSerializer(opts record.Options) (Serializer, error) {
+	return json.NewSerializer(opts), nil
+}
+
+// NewProtobufSerializer provides a 'protobuf' Serializer
+func NewProtobufSerializer(opts record.Options) (Serializer, error) {
+	return &protobuf.Serializer{
+		Options: opts,
+	}, nil
+}
+
+// NewAvroSerializer provides a binary 'avro' Serializer
+func NewAvroSerializer(opts record.Options) (Serializer, error) {
+	ser, err := avrojson.NewSerializer(opts)
+	if err != nil {
+		log.ErrorObj(err).Msg("Failed to create avro codec")
+		return nil, err
+	}
+
+	ser.Binary = true
+	return ser, nil
 }
 
 // NewAvroJSONSerializer provides a 'avro-json' Serializer
-func NewAvroJSONSerializer() (Serializer, error) {
-	codec, err := goavro.NewCodec(avrojson.SCHEMA)
+func NewAvroJSONSerializer(opts record.Options) (Serializer, error) {
+	ser, err := avrojson.NewSerializer(opts)
 	if err != nil {
 		log.ErrorObj(err).Msg("Failed to create avro codec")
 		return nil, err
 	}
 
-	return &avrojson.Serializer{
-		Codec: codec,
-	}, nil
+	return ser, nil
 }
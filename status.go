@@ -0,0 +1,277 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/redact"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/remote"
+)
+
+const (
+	// statusAPIPath is the path of the status API.
+	statusAPIPath = "/api/v1/status"
+	// statusPagePath is the path of the status page.
+	statusPagePath = "/status"
+)
+
+// runtimeInformer is implemented by writers which know the runtime information of their Event Hub
+type runtimeInformer interface {
+	RuntimeInfo() eventhub.HubRuntimeInformation
+}
+
+// targetStats counts the samples written to a target, a writer by name
+type targetStats struct {
+	Writes          int        `json:"writes"`
+	Sent            int        `json:"sent"`
+	SendFailed      int        `json:"send_failed"`
+	SerializeFailed int        `json:"serialize_failed"`
+	Dropped         int        `json:"dropped"`
+	Bytes           int        `json:"bytes"`
+	CompressedBytes int        `json:"compressed_bytes"`
+	LastSend        *time.Time `json:"last_send,omitempty"`
+	LastError       *sendError `json:"last_error,omitempty"`
+}
+
+// sendError is a failed write
+type sendError struct {
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target"`
+	Message string    `json:"message"`
+}
+
+// sendState tracks the writes reported by the status API
+type sendState struct {
+	mu        sync.Mutex
+	started   time.Time
+	lastSend  *time.Time
+	lastError *sendError
+	targets   map[string]*targetStats
+}
+
+// sends is the state of the writes reported by the status API.
+var sends = &sendState{started: time.Now(), targets: map[string]*targetStats{}}
+
+// record adds the result of a write to a target
+func (s *sendState) record(target string, result remote.Result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.targets[target]
+	if !ok {
+		stats = &targetStats{}
+		s.targets[target] = stats
+	}
+	stats.Writes++
+	stats.Sent += result.Sent
+	stats.SendFailed += result.SendFailed
+	stats.SerializeFailed += result.SerializeFailed
+	stats.Dropped += result.Dropped
+	stats.Bytes += result.Bytes
+	stats.CompressedBytes += result.CompressedBytes
+
+	now := time.Now()
+	if err != nil {
+		stats.LastError = &sendError{Time: now, Target: target, Message: redact.String(err.Error())}
+		s.lastError = stats.LastError
+		return
+	}
+	if result.Sent > 0 {
+		stats.LastSend = &now
+		s.lastSend = &now
+	}
+}
+
+// buildInfo identifies the adapter build
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Build     string `json:"build"`
+	GoVersion string `json:"go_version"`
+}
+
+// hubInfo is the runtime information of the Event Hub written to
+type hubInfo struct {
+	Path           string    `json:"path"`
+	CreatedAt      time.Time `json:"created_at"`
+	PartitionCount int       `json:"partition_count"`
+	PartitionIDs   []string  `json:"partition_ids"`
+}
+
+// status is the response of the status API
+type status struct {
+	Build     buildInfo               `json:"build"`
+	Started   time.Time               `json:"started"`
+	Uptime    string                  `json:"uptime"`
+	Ready     bool                    `json:"ready"`
+	Writer    string                  `json:"writer"`
+	Hub       *hubInfo                `json:"hub,omitempty"`
+	LastSend  *time.Time              `json:"last_send,omitempty"`
+	LastError *sendError              `json:"last_error,omitempty"`
+	Targets   map[string]*targetStats `json:"targets"`
+	Config    map[string]interface{}  `json:"config"`
+}
+
+// currentStatus collects the status of the adapter writing with w
+func currentStatus(w *swapWriter) *status {
+	st := &status{
+		Build: buildInfo{
+			Version:   Version,
+			Commit:    Commit,
+			Build:     Build,
+			GoVersion: runtime.Version(),
+		},
+		Ready: ready(health.checks()),
+	}
+
+	a := w.acquire()
+	st.Writer = a.Name()
+	if ri, ok := a.writer.(runtimeInformer); ok {
+		info := ri.RuntimeInfo()
+		st.Hub = &hubInfo{
+			Path:           info.Path,
+			CreatedAt:      info.CreatedAt,
+			PartitionCount: info.PartitionCount,
+			PartitionIDs:   info.PartitionIDs,
+		}
+	}
+	a.writes.Done()
+
+	sends.mu.Lock()
+	st.Started = sends.started
+	st.Uptime = time.Since(sends.started).Round(time.Second).String()
+	st.LastSend, st.LastError = sends.lastSend, sends.lastError
+	st.Targets = make(map[string]*targetStats, len(sends.targets))
+	for target, stats := range sends.targets {
+		copied := *stats
+		st.Targets[target] = &copied
+	}
+	sends.mu.Unlock()
+
+	configMu.RLock()
+	st.Config = settingsRedactor.Settings(viper.AllSettings())
+	configMu.RUnlock()
+	for key, value := range st.Config {
+		// Durations set by flags and defaults would show as nanoseconds
+		if d, ok := value.(time.Duration); ok {
+			st.Config[key] = d.String()
+		}
+	}
+
+	return st
+}
+
+// statusHandler responds with the status of the adapter as JSON
+func statusHandler(w *swapWriter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentStatus(w))
+	}
+}
+
+// statusPage renders the status of the adapter.
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return string(data), err
+	},
+	"keys": func(m map[string]interface{}) []string {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prometheus-eventhubs-adapter status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.fail { color: #b00; }
+</style>
+</head>
+<body>
+<h1>prometheus-eventhubs-adapter</h1>
+
+<h2>Build</h2>
+<table>
+<tr><th>Version</th><td>{{ .Build.Version }}</td></tr>
+<tr><th>Commit</th><td>{{ .Build.Commit }}</td></tr>
+<tr><th>Build</th><td>{{ .Build.Build }}</td></tr>
+<tr><th>Go</th><td>{{ .Build.GoVersion }}</td></tr>
+<tr><th>Started</th><td>{{ .Started.Format "2006-01-02T15:04:05Z07:00" }} ({{ .Uptime }})</td></tr>
+<tr><th>Ready</th><td>{{ if .Ready }}yes{{ else }}<span class="fail">no</span>{{ end }}</td></tr>
+</table>
+
+<h2>Writer</h2>
+<table>
+<tr><th>Writer</th><td>{{ .Writer }}</td></tr>
+{{- with .Hub }}
+<tr><th>Event Hub</th><td>{{ .Path }}</td></tr>
+<tr><th>Partitions</th><td>{{ .PartitionCount }} {{ .PartitionIDs }}</td></tr>
+{{- end }}
+<tr><th>Last send</th><td>{{ with .LastSend }}{{ .Format "2006-01-02T15:04:05Z07:00" }}{{ else }}never{{ end }}</td></tr>
+<tr><th>Last error</th><td>{{ with .LastError }}<span class="fail">{{ .Time.Format "2006-01-02T15:04:05Z07:00" }} {{ .Target }}: {{ .Message }}</span>{{ else }}none{{ end }}</td></tr>
+</table>
+
+<h2>Targets</h2>
+<table>
+<tr><th>Target</th><th>Writes</th><th>Sent</th><th>Send failed</th><th>Serialize failed</th><th>Dropped</th><th>Bytes</th><th>Compressed bytes</th><th>Last send</th><th>Last error</th></tr>
+{{- range $target, $stats := .Targets }}
+<tr><td>{{ $target }}</td><td>{{ .Writes }}</td><td>{{ .Sent }}</td><td>{{ .SendFailed }}</td><td>{{ .SerializeFailed }}</td><td>{{ .Dropped }}</td><td>{{ .Bytes }}</td><td>{{ .CompressedBytes }}</td>
+<td>{{ with .LastSend }}{{ .Format "2006-01-02T15:04:05Z07:00" }}{{ end }}</td><td>{{ with .LastError }}<span class="fail">{{ .Message }}</span>{{ end }}</td></tr>
+{{- end }}
+</table>
+
+<h2>Configuration</h2>
+<table>
+{{- range $key := keys .Config }}
+<tr><th>{{ $key }}</th><td>{{ json (index $.Config $key) }}</td></tr>
+{{- end }}
+</table>
+
+<p><a href="` + statusAPIPath + `">JSON</a></p>
+</body>
+</html>
+`))
+
+// statusPageHandler responds with the status of the adapter as an HTML page
+func statusPageHandler(w *swapWriter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := statusPage.Execute(c.Writer, currentStatus(w)); err != nil {
+			c.Error(err)
+		}
+	}
+}
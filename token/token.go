@@ -0,0 +1,71 @@
+// Package token provides Azure Active Directory bearer tokens for the Azure
+// REST APIs used by the adapter.
+package token
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Config for an Azure Active Directory service principal
+type Config struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+// Enabled reports whether a service principal is configured.
+func (cfg *Config) Enabled() bool {
+	return cfg.TenantID != "" && cfg.ClientID != "" && cfg.ClientSecret != ""
+}
+
+// Provider supplies bearer tokens for a single resource
+type Provider struct {
+	spt *adal.ServicePrincipalToken
+}
+
+// NewProvider creates a token provider for the resource, ex. "https://eventhubs.azure.net"
+func NewProvider(cfg *Config, resource string) (*Provider, error) {
+	if !cfg.Enabled() {
+		return nil, errors.New("missing tenant id, client id or client secret")
+	}
+
+	oauth, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, cfg.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	spt, err := adal.NewServicePrincipalToken(*oauth, cfg.ClientID, cfg.ClientSecret, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Provider{spt: spt}, nil
+}
+
+// Token returns a valid bearer token, refreshing it when needed
+func (p *Provider) Token(ctx context.Context) (string, error) {
+	if err := p.spt.EnsureFreshWithContext(ctx); err != nil {
+		return "", err
+	}
+	return p.spt.OAuthToken(), nil
+}
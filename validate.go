@@ -0,0 +1,407 @@
+package main
+
+/*
+  Copyright 2019 Micron Technology, Inc.
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/adx"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/cloudevents"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/compression"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/kafka"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/log"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/redact"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/routing"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers"
+	"github.com/bryanklewis/prometheus-eventhubs-adapter/serializers/record"
+)
+
+// envPrefix is the prefix of configuration environment variables, see viper.SetEnvPrefix.
+const envPrefix = "ADAP_"
+
+// configFileErr is the error reading the configuration file at startup, if any.
+var configFileErr error
+
+// problem is an invalid setting found by validateConfig.
+type problem struct {
+	key     string
+	message string
+	// warning problems don't stop the adapter from starting or reloading,
+	// only the validate subcommand fails on them.
+	warning bool
+}
+
+func (p problem) String() string {
+	return p.key + ": " + p.message
+}
+
+// validateCommand prints a report of the configuration problems
+//
+// Usage: validate
+//
+// returns an error when the configuration has problems.
+func validateCommand(out io.Writer) error {
+	problems := validateConfig()
+	printProblems(out, problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("%d configuration problems", len(problems))
+	}
+	return nil
+}
+
+// printProblems prints the configuration file used and each problem
+func printProblems(out io.Writer, problems []problem) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(out, "Configuration file: %s\n", file)
+
+	if len(problems) == 0 {
+		fmt.Fprintln(out, "Configuration is valid")
+		return
+	}
+	for _, p := range problems {
+		fmt.Fprintf(out, "  %s\n", redact.String(p.String()))
+	}
+	if len(problems) == 1 {
+		fmt.Fprintln(out, "1 problem found")
+	} else {
+		fmt.Fprintf(out, "%d problems found\n", len(problems))
+	}
+}
+
+// splitWarnings separates the warnings from the problems which stop the adapter
+func splitWarnings(all []problem) (problems, warnings []problem) {
+	for _, p := range all {
+		if p.warning {
+			warnings = append(warnings, p)
+		} else {
+			problems = append(problems, p)
+		}
+	}
+	return problems, warnings
+}
+
+// logWarnings logs the warnings of the configuration
+func logWarnings(warnings []problem) {
+	for _, p := range warnings {
+		log.Warn().Str("key", p.key).Msg(redact.String(p.message))
+	}
+}
+
+// problemsError combines problems into an error
+func problemsError(problems []problem) error {
+	errs := make([]error, len(problems))
+	for i, p := range problems {
+		errs[i] = errors.New(p.String())
+	}
+	return errors.Join(errs...)
+}
+
+// validateConfig checks the effective configuration, returning every problem found
+func validateConfig() []problem {
+	var problems []problem
+	add := func(key string, err error) {
+		if err != nil {
+			problems = append(problems, problem{key: key, message: err.Error()})
+		}
+	}
+
+	if configFileErr != nil {
+		add(viper.ConfigFileUsed(), configFileErr)
+	}
+	problems = append(problems, unknownKeys()...)
+	problems = append(problems, wrongTypes()...)
+	problems = append(problems, secretProblems()...)
+
+	_, err := log.ParseLevel(viper.GetString("log_level"))
+	add("log_level", err)
+
+	_, err = record.ParsePolicy(viper.GetString("write_nan_policy"))
+	add("write_nan_policy", err)
+	_, err = record.ParsePolicy(viper.GetString("write_stale_policy"))
+	add("write_stale_policy", err)
+
+	cfg := getWriterConfig()
+	_, err = serializers.NewSerializer(&cfg.Serializer)
+	add("write_serializer", err)
+	codec, err := compression.ParseCodec(cfg.Compression)
+	add("write_compression", err)
+	if codec != compression.NoCompression && viper.GetString("write_destination") != adxDestination {
+		add("write_compression", compressionInflates(cfg.Serializer.DataFormat, cfg.CloudEvents.Mode))
+	}
+	_, err = routing.New(cfg.RoutingConfig())
+	add("write_adxtable", err)
+	if cfg.CloudEvents.Enabled() {
+		_, err = cloudevents.New(&cfg.CloudEvents)
+		add("cloudevents_mode", err)
+	}
+
+	switch dest := viper.GetString("write_destination"); dest {
+	case eventHubDestination:
+		problems = append(problems, hubCredentials()...)
+		if cfg.CloudEvents.Enabled() {
+			// The Event Hubs client library sends no content-type message property
+			problems = append(problems, problem{key: "cloudevents_mode", message: "events are sent over connections opened by the adapter instead of the Event Hubs client library, which reconnect once per send without the library's link recovery and retries", warning: true})
+		}
+	case kafkaDestination:
+		switch strings.ToLower(viper.GetString("kafka_sasl_mechanism")) {
+		case "", kafka.SASLPlain, kafka.SASLOAuthBearer, kafka.SASLNone:
+		default:
+			add("kafka_sasl_mechanism", fmt.Errorf("unknown kafka SASL mechanism '%s'", viper.GetString("kafka_sasl_mechanism")))
+		}
+		if acks := viper.GetInt("kafka_acks"); acks != 1 && acks != -1 {
+			add("kafka_acks", fmt.Errorf("kafka acks must be 1 or -1, not %d", acks))
+		}
+		if len(viper.GetStringSlice("kafka_brokers")) == 0 {
+			problems = append(problems, hubCredentials()...)
+		}
+	case adxDestination:
+		if !getADXConfig().Enabled() {
+			add("adx_endpoint", errors.New("adx_endpoint and adx_database are required by the adx destination"))
+		}
+		switch strings.ToLower(viper.GetString("adx_ingest_mode")) {
+		case "", adx.StreamingIngestion, adx.QueuedIngestion:
+		default:
+			add("adx_ingest_mode", fmt.Errorf("unknown adx ingestion mode '%s'", viper.GetString("adx_ingest_mode")))
+		}
+	default:
+		add("write_destination", fmt.Errorf("unknown write destination '%s'", dest))
+	}
+
+	problems = append(problems, pathCollisions()...)
+	return problems
+}
+
+// compressionInflates returns an error for the binary serializers, whose
+// single-sample events are made larger by every codec
+//
+// A structured CloudEvents envelope is JSON and still compresses.
+func compressionInflates(format, cloudEventsMode string) error {
+	if strings.EqualFold(cloudEventsMode, cloudevents.StructuredMode) {
+		return nil
+	}
+	switch f := strings.ToLower(format); f {
+	case "avro", "protobuf":
+		return fmt.Errorf("%s events hold a single binary encoded sample, which compression makes larger", f)
+	}
+	return nil
+}
+
+// unknownKeys returns the settings of the configuration file and environment which are not configuration options
+//
+// Unknown environment variables are warnings, they may be set for other
+// versions of the adapter.
+func unknownKeys() []problem {
+	var problems []problem
+
+	if file := viper.ConfigFileUsed(); file != "" && configFileErr == nil {
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.SetConfigType("toml")
+		if err := v.ReadInConfig(); err == nil {
+			keys := make([]string, 0)
+			for key := range v.AllSettings() {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if pflag.Lookup(key) == nil {
+					problems = append(problems, problem{key: key, message: "unknown setting in " + file})
+				}
+			}
+		}
+	}
+
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if key := strings.ToLower(strings.TrimPrefix(name, envPrefix)); pflag.Lookup(key) == nil {
+			problems = append(problems, problem{key: name, message: "unknown environment variable", warning: true})
+		}
+	}
+	return problems
+}
+
+// wrongTypes returns the settings whose value does not convert to the type of their flag
+//
+// viper returns the zero value for such settings instead of an error.
+func wrongTypes() []problem {
+	var problems []problem
+	pflag.VisitAll(func(f *pflag.Flag) {
+		value := viper.Get(f.Name)
+		if value == nil {
+			return
+		}
+
+		var err error
+		switch f.Value.Type() {
+		case "bool":
+			_, err = cast.ToBoolE(value)
+		case "int":
+			_, err = cast.ToIntE(value)
+		case "float64":
+			_, err = cast.ToFloat64E(value)
+		case "duration":
+			_, err = cast.ToDurationE(value)
+		case "string":
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				err = fmt.Errorf("unable to cast %#v of type %T to string", value, value)
+			}
+		case "stringSlice":
+			_, err = cast.ToStringSliceE(value)
+		case "stringToString":
+			_, err = cast.ToStringMapStringE(value)
+		}
+		switch {
+		case err == nil:
+		case settingsRedactor.Sensitive(f.Name):
+			// The error shows the value
+			problems = append(problems, problem{key: f.Name, message: "expected " + f.Value.Type()})
+		default:
+			problems = append(problems, problem{key: f.Name, message: "expected " + f.Value.Type() + ", " + err.Error()})
+		}
+	})
+	return problems
+}
+
+// secretProblems returns the secrets set both directly and by file, and the secret files which can't be read
+func secretProblems() []problem {
+	var problems []problem
+	for _, key := range secretKeys {
+		fileKey := key + secretFileSuffix
+		file := viper.GetString(fileKey)
+		if file == "" {
+			continue
+		}
+		if viper.GetString(key) != "" {
+			problems = append(problems, problem{key: fileKey, message: "conflicts with " + key + ", use either"})
+		}
+		if _, err := readSecretFile(file); err != nil {
+			problems = append(problems, problem{key: fileKey, message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// hubCredentials returns the missing, incomplete and conflicting Event Hub credentials
+//
+// Only the first credential set found is used to connect, see newHubFromConfig.
+func hubCredentials() []problem {
+	var problems []problem
+	add := func(key, message string) {
+		problems = append(problems, problem{key: key, message: message})
+	}
+	set := func(key string) bool {
+		return secretString(key) != ""
+	}
+
+	connString := set("write_connstring")
+	sasKey := set("write_keyname") || set("write_keyvalue")
+	secret := set("write_clientsecret")
+	cert := set("write_certpath") || set("write_certpassword")
+
+	switch {
+	case connString && (set("write_namespace") || sasKey):
+		add("write_connstring", "conflicts with write_namespace, write_keyname and write_keyvalue, use either")
+	case !connString && !(set("write_namespace") && set("write_hub")):
+		add("write_namespace", "write_namespace and write_hub, or write_connstring, are required")
+	}
+
+	if connString && (secret || cert) {
+		add("write_connstring", "conflicts with the AAD credentials write_clientsecret and write_certpath, use either")
+	}
+	if sasKey && !(set("write_keyname") && set("write_keyvalue")) {
+		add("write_keyname", "write_keyname and write_keyvalue must be set together")
+	}
+	if secret && cert {
+		add("write_clientsecret", "conflicts with write_certpath, use either")
+	}
+	if cert && !(set("write_certpath") && set("write_certpassword")) {
+		add("write_certpath", "write_certpath and write_certpassword must be set together")
+	}
+	if (secret || cert) && !(set("write_tenantid") && set("write_clientid")) {
+		add("write_tenantid", "write_tenantid and write_clientid are required by AAD credentials")
+	}
+	if !connString && !sasKey && !secret && !cert {
+		add("write_keyname", "no Event Hub credentials, set write_connstring, write_keyname and write_keyvalue, or AAD credentials")
+	}
+	return problems
+}
+
+// routePaths returns the HTTP paths served by the adapter, by setting
+func routePaths() map[string]string {
+	paths := map[string]string{
+		"write_path":     viper.GetString("write_path"),
+		"telemetry_path": viper.GetString("telemetry_path"),
+	}
+	for _, key := range []string{"otlp_path", "influx_path"} {
+		if path := viper.GetString(key); path != "" {
+			paths[key] = path
+		}
+	}
+	if getADXConfig().Enabled() {
+		paths["read_path"] = viper.GetString("read_path")
+	}
+	return paths
+}
+
+// pathCollisions returns the HTTP paths which are invalid or served by more than one route
+func pathCollisions() []problem {
+	paths := routePaths()
+	keys := make([]string, 0, len(paths))
+	for key := range paths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []problem
+	used := map[string]string{
+		healthyPath: "the health endpoint",
+		readyPath:   "the readiness endpoint",
+	}
+	if viper.GetBool("status_enabled") {
+		used[statusAPIPath] = "the status API"
+		used[statusPagePath] = "the status page"
+	}
+	for _, key := range keys {
+		path := paths[key]
+		if !strings.HasPrefix(path, "/") {
+			problems = append(problems, problem{key: key, message: fmt.Sprintf("path '%s' must start with '/'", path)})
+			continue
+		}
+		if other, ok := used[path]; ok {
+			problems = append(problems, problem{key: key, message: fmt.Sprintf("path '%s' is also used by %s", path, other)})
+			continue
+		}
+		used[path] = key
+	}
+	return problems
+}